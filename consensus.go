@@ -0,0 +1,337 @@
+// consensus.go - Katzenpost self contained test network consensus helpers.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+)
+
+const consensusPollInterval = 5 * time.Second
+
+// ConsensusState is how complete an observed consensus is.
+type ConsensusState int
+
+const (
+	// ConsensusNone is the state when there is no consensus for the
+	// current epoch.
+	ConsensusNone ConsensusState = iota
+
+	// ConsensusPartial is the state when the consensus lacks some of the
+	// nodes, or the signatures of some of the voting authorities.
+	ConsensusPartial
+
+	// ConsensusFull is the state when the consensus includes every node
+	// and is signed by every authority.
+	ConsensusFull
+)
+
+func (s ConsensusState) String() string {
+	switch s {
+	case ConsensusNone:
+		return "none"
+	case ConsensusPartial:
+		return "partial"
+	case ConsensusFull:
+		return "full"
+	default:
+		return fmt.Sprintf("[unknown state: %d]", int(s))
+	}
+}
+
+// WaitForReady blocks until the authorities publish a consensus for the
+// current epoch that includes every node, or the context is done, and
+// returns the last observed state.  A ready network's consensus is
+// ConsensusFull, or ConsensusPartial if it lacks the signatures of some of
+// the voting authorities; use WaitForConsensus to wait for full agreement.
+func (k *Kimchi) WaitForReady(ctx context.Context) (ConsensusState, error) {
+	p, err := k.PKIClient()
+	if err != nil {
+		return ConsensusNone, err
+	}
+	for {
+		observed, missing := k.observeConsensus(ctx, p)
+		if len(missing) == 0 {
+			return observed, nil
+		}
+		select {
+		case <-ctx.Done():
+			return observed, ctx.Err()
+		case <-time.After(consensusPollInterval):
+		}
+	}
+}
+
+// WaitForConsensus blocks until a consensus for the current epoch reaching
+// at least the given state is observed, or the context is done, and
+// returns the last observed state.
+func (k *Kimchi) WaitForConsensus(ctx context.Context, state ConsensusState) (ConsensusState, error) {
+	p, err := k.PKIClient()
+	if err != nil {
+		return ConsensusNone, err
+	}
+	for {
+		observed, _ := k.observeConsensus(ctx, p)
+		if observed >= state {
+			return observed, nil
+		}
+		select {
+		case <-ctx.Done():
+			return observed, ctx.Err()
+		case <-time.After(consensusPollInterval):
+		}
+	}
+}
+
+// observeConsensus fetches the consensus for the current epoch, and
+// returns its state and the nodes missing from it.
+func (k *Kimchi) observeConsensus(ctx context.Context, p pki.Client) (ConsensusState, []string) {
+	epoch, _, _ := epochtime.Now()
+	state := ConsensusNone
+	k.Lock()
+	missing := k.nodeIdentifiers()
+	k.Unlock()
+	doc, raw, err := p.Get(ctx, epoch)
+	if err == nil {
+		missing = k.missingNodes(doc)
+		state = ConsensusPartial
+		if len(missing) == 0 && k.fullySigned(raw) {
+			state = ConsensusFull
+		}
+	}
+	k.Lock()
+	k.lastMissing = missing
+	if err == nil && k.readyTimings != nil {
+		// Record when each node first appears in a consensus.
+		for _, id := range k.nodeIdentifiers() {
+			if _, ok := k.readyTimings[id]; !ok && !containsString(missing, id) {
+				k.readyTimings[id] = time.Since(k.runStart)
+			}
+		}
+	}
+	k.Unlock()
+	return state, missing
+}
+
+// fullySigned returns true iff the raw consensus carries a signature from
+// every authority.
+func (k *Kimchi) fullySigned(raw []byte) bool {
+	if !k.voting {
+		return true
+	}
+	sigs, err := cert.GetSignatures(raw)
+	if err != nil {
+		return false
+	}
+	signed := make(map[string]bool)
+	for _, sig := range sigs {
+		signed[string(sig.Identity)] = true
+	}
+	for _, aCfg := range k.votingAuthConfigs {
+		if !signed[string(aCfg.Debug.IdentityKey.PublicKey().Identity())] {
+			return false
+		}
+	}
+	return true
+}
+
+// ConsensusSigners returns the identifiers of the authorities whose
+// signatures are on the current epoch's consensus.  A signature by any
+// other key is reported as "unknown-" followed by the hex key identity.
+func (k *Kimchi) ConsensusSigners() ([]string, error) {
+	p, err := k.PKIClient()
+	if err != nil {
+		return nil, err
+	}
+	epoch, _, _ := epochtime.Now()
+	raw, err := retry(p, epoch, 3)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := cert.GetSignatures(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	if k.voting {
+		for _, aCfg := range k.votingAuthConfigs {
+			names[string(aCfg.Debug.IdentityKey.PublicKey().Identity())] = aCfg.Authority.Identifier
+		}
+	} else {
+		names[string(k.authConfig.Debug.IdentityKey.PublicKey().Identity())] = "nonvoting"
+	}
+	var signers []string
+	for _, sig := range sigs {
+		name, ok := names[string(sig.Identity)]
+		if !ok {
+			name = fmt.Sprintf("unknown-%x", sig.Identity)
+		}
+		signers = append(signers, name)
+	}
+	return signers, nil
+}
+
+// Consensus returns the authorities' PKI document for the current epoch.
+func (k *Kimchi) Consensus() (*pki.Document, error) {
+	p, err := k.PKIClient()
+	if err != nil {
+		return nil, err
+	}
+	epoch, _, _ := epochtime.Now()
+	raw, err := retry(p, epoch, 3)
+	if err != nil {
+		return nil, err
+	}
+	return p.Deserialize(raw)
+}
+
+// CurrentEpoch returns the epoch of the authorities' current consensus.
+func (k *Kimchi) CurrentEpoch() (uint64, error) {
+	doc, err := k.Consensus()
+	if err != nil {
+		return 0, err
+	}
+	return doc.Epoch, nil
+}
+
+// WaitForEpoch blocks until the authorities have published a consensus for
+// epoch, or the context is done.
+func (k *Kimchi) WaitForEpoch(ctx context.Context, epoch uint64) error {
+	p, err := k.PKIClient()
+	if err != nil {
+		return err
+	}
+	for {
+		wait := consensusPollInterval
+		if now, _, till := epochtime.Now(); now < epoch {
+			wait = till + time.Duration(epoch-now-1)*epochtime.Period
+		} else if _, _, err := p.Get(ctx, epoch); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// VerifyAllNodesInConsensus fetches the consensus for the current epoch and
+// returns an error listing every node that is missing from it.
+func (k *Kimchi) VerifyAllNodesInConsensus(ctx context.Context) error {
+	p, err := k.PKIClient()
+	if err != nil {
+		return err
+	}
+	epoch, _, _ := epochtime.Now()
+	doc, _, err := p.Get(ctx, epoch)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the consensus for epoch %v: %w", epoch, err)
+	}
+	if missing := k.missingNodes(doc); len(missing) != 0 {
+		return fmt.Errorf("nodes missing from the consensus for epoch %v: %v", epoch, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// NodeDescriptor returns the descriptor that the named node published in
+// the current consensus.
+func (k *Kimchi) NodeDescriptor(identifier string) (*pki.MixDescriptor, error) {
+	if _, err := k.nodeConfig(identifier); err != nil {
+		return nil, err
+	}
+	doc, err := k.Consensus()
+	if err != nil {
+		return nil, err
+	}
+	desc, err := doc.GetNode(identifier)
+	if err != nil {
+		return nil, fmt.Errorf("%v is not in the consensus: %w", identifier, ErrNodeNotFound)
+	}
+	return desc, nil
+}
+
+// OnReady registers fn to be called once the first consensus covering all
+// nodes is observed.  If that has already happened fn is called at once.
+func (k *Kimchi) OnReady(fn func()) {
+	k.Lock()
+	defer k.Unlock()
+	if k.ready {
+		go fn()
+		return
+	}
+	k.readyFns = append(k.readyFns, fn)
+}
+
+// missingNodes returns the identifiers of the nodes absent from doc.
+func (k *Kimchi) missingNodes(doc *pki.Document) []string {
+	k.Lock()
+	defer k.Unlock()
+	var missing []string
+	for _, id := range k.nodeIdentifiers() {
+		if _, err := doc.GetNode(id); err != nil {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// nodeIdentifiers returns the identifiers of every node.  The caller must
+// hold the lock, as AddMix may be adding a node.
+func (k *Kimchi) nodeIdentifiers() []string {
+	ids := make([]string, 0, len(k.nodeConfigs))
+	for _, nodeCfg := range k.nodeConfigs {
+		ids = append(ids, nodeCfg.Server.Identifier)
+	}
+	return ids
+}
+
+// consensusWatcher marks the network ready once WaitForReady succeeds, and
+// gives up when haltCh is closed.  The caller must have called k.Add(1).
+func (k *Kimchi) consensusWatcher(haltCh <-chan struct{}) {
+	defer k.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-haltCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if _, err := k.WaitForReady(ctx); err != nil {
+		return
+	}
+
+	k.Lock()
+	k.ready = true
+	fns := k.readyFns
+	k.readyFns = nil
+	k.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
@@ -0,0 +1,233 @@
+// faults.go - Katzenpost self contained test network fault injection.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+)
+
+// FaultInjection configures the TCP proxies that are placed in front of
+// every node and authority when it is set.  Nodes advertise the proxy
+// addresses, and the authority addresses handed to peers, nodes and
+// clients are the proxy addresses, so all traffic flows through them.
+type FaultInjection struct {
+	// Delay is added before forwarding each chunk of data read from
+	// either side of a connection.
+	Delay time.Duration
+
+	// DropProbability is the probability, between 0 and 1, that a new
+	// connection is closed as soon as it is accepted.
+	DropProbability float64
+}
+
+func (f *FaultInjection) validate() error {
+	if f.Delay < 0 {
+		return fmt.Errorf("invalid fault injection delay: %v", f.Delay)
+	}
+	if f.DropProbability < 0 || f.DropProbability > 1 {
+		return fmt.Errorf("invalid fault injection drop probability: %v", f.DropProbability)
+	}
+	return nil
+}
+
+type faultProxy struct {
+	front, backend string
+	l              net.Listener
+	conns          map[net.Conn]bool
+}
+
+// frontAddress allocates a proxy front end for a component listening on
+// backend, if fault injection is enabled, and returns the address that
+// should be handed out for it, on Options.AdvertiseHost if that is set.
+func (k *Kimchi) frontAddress(c portClass, backend string) (string, error) {
+	front := backend
+	if k.opts.Faults != nil {
+		var err error
+		if front, err = k.nextAddress(c); err != nil {
+			return "", err
+		}
+		k.faultProxies = append(k.faultProxies, &faultProxy{front: front, backend: backend})
+	}
+	if k.opts.AdvertiseHost != "" {
+		_, port, err := net.SplitHostPort(front)
+		if err != nil {
+			return "", err
+		}
+		front = net.JoinHostPort(k.opts.AdvertiseHost, port)
+	}
+	if front != backend {
+		k.frontAddrs[backend] = front
+	}
+	return front, nil
+}
+
+// addressTransport returns the PKI transport of an IP:port address.
+func addressTransport(addr string) pki.Transport {
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return pki.TransportTCPv6
+		}
+	}
+	return pki.TransportTCPv4
+}
+
+// advertisedAddresses maps component listen addresses to the addresses
+// that should be handed out for them.
+func (k *Kimchi) advertisedAddresses(addrs []string) []string {
+	r := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if front, ok := k.frontAddrs[addr]; ok {
+			addr = front
+		}
+		r = append(r, addr)
+	}
+	return r
+}
+
+func (k *Kimchi) startFaultProxies() error {
+	for _, p := range k.faultProxies {
+		if err := k.startFaultProxy(p); err != nil {
+			k.stopFaultProxies()
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Kimchi) startFaultProxy(p *faultProxy) error {
+	l, err := net.Listen("tcp", p.front)
+	if err != nil {
+		return err
+	}
+	k.Lock()
+	p.l = l
+	p.conns = make(map[net.Conn]bool)
+	k.Unlock()
+	k.Add(1)
+	go k.faultProxyWorker(p, l)
+	return nil
+}
+
+func (k *Kimchi) stopFaultProxies() {
+	k.Lock()
+	defer k.Unlock()
+	for _, p := range k.faultProxies {
+		k.stopFaultProxy(p)
+	}
+}
+
+// stopFaultProxy closes the proxy's listener and every connection it is
+// forwarding.  The caller must hold the lock.
+func (k *Kimchi) stopFaultProxy(p *faultProxy) {
+	if p.l != nil {
+		p.l.Close()
+		p.l = nil
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+// trackConn records a connection forwarded by the proxy, so that it is
+// closed when the proxy stops.  If the proxy has already stopped, conn is
+// closed and false is returned.
+func (k *Kimchi) trackConn(p *faultProxy, conn net.Conn) bool {
+	k.Lock()
+	defer k.Unlock()
+	if p.conns == nil {
+		conn.Close()
+		return false
+	}
+	p.conns[conn] = true
+	return true
+}
+
+func (k *Kimchi) untrackConn(p *faultProxy, conn net.Conn) {
+	k.Lock()
+	defer k.Unlock()
+	delete(p.conns, conn)
+}
+
+func (k *Kimchi) faultProxyWorker(p *faultProxy, l net.Listener) {
+	defer k.Done()
+	m := rand.NewMath()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if m.Float64() < k.opts.Faults.DropProbability {
+			log.Printf("Fault injection: dropping connection to %v", p.backend)
+			conn.Close()
+			continue
+		}
+		k.Add(1)
+		go k.faultProxyConn(p, conn)
+	}
+}
+
+func (k *Kimchi) faultProxyConn(p *faultProxy, conn net.Conn) {
+	defer k.Done()
+	if !k.trackConn(p, conn) {
+		return
+	}
+	defer k.untrackConn(p, conn)
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		return
+	}
+	if !k.trackConn(p, upstream) {
+		return
+	}
+	defer k.untrackConn(p, upstream)
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	k.Add(2)
+	go k.delayedCopy(upstream, conn, done)
+	go k.delayedCopy(conn, upstream, done)
+	<-done
+}
+
+func (k *Kimchi) delayedCopy(dst, src net.Conn, done chan<- struct{}) {
+	defer k.Done()
+	defer func() {
+		done <- struct{}{}
+	}()
+	var buf [32 * 1024]byte
+	for {
+		n, err := src.Read(buf[:])
+		if n > 0 {
+			time.Sleep(k.opts.Faults.Delay)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// keyserver.go - Katzenpost self contained test network keyserver queries.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/katzenpost/client/session"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+const (
+	keyserverVersion  = 0
+	keyserverStatusOk = 0
+)
+
+type keyserverRequest struct {
+	Version int
+	User    string
+}
+
+type keyserverResponse struct {
+	Version    int
+	StatusCode int
+	User       string
+	PublicKey  string
+}
+
+// QueryKeyserver looks up the identity key of user through the named
+// provider's keyserver service, sending the query across the network from
+// a throwaway client account.
+func (k *Kimchi) QueryKeyserver(ctx context.Context, user, provider string) (*ecdh.PublicKey, error) {
+	cfg, err := k.nodeConfig(provider)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Server.IsProvider {
+		return nil, fmt.Errorf("%v: %w", provider, ErrNotAProvider)
+	}
+	req, err := json.Marshal(&keyserverRequest{Version: keyserverVersion, User: user})
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey := new(ecdh.PublicKey)
+	err = k.withSession(ctx, "keyserver", func(s *session.Session) error {
+		reply, err := s.SendUnreliableMessage(k.opts.Services.Keyserver.Endpoint, provider, req)
+		if err != nil {
+			return err
+		}
+		var resp keyserverResponse
+		if err = json.Unmarshal(bytes.TrimRight(reply, "\x00"), &resp); err != nil {
+			return fmt.Errorf("invalid keyserver reply: %w", err)
+		}
+		if resp.StatusCode != keyserverStatusOk {
+			return fmt.Errorf("keyserver query for %v@%v failed with status %v", user, provider, resp.StatusCode)
+		}
+		return pubKey.FromString(resp.PublicKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pubKey, nil
+}
@@ -19,17 +19,25 @@ package kimchi
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/textproto"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hpcloud/tail"
@@ -51,7 +59,37 @@ import (
 )
 
 const (
-	logFile  = "kimchi.log"
+	logFile = "kimchi.log"
+
+	// managementSocket is the name of a provider's management socket,
+	// within its data directory.
+	managementSocket = "management_sock"
+
+	// maxLayers is the most mix layers the authorities support.
+	maxLayers = 3
+
+	defaultManagementDialTimeout = 10 * time.Second
+
+	// raceTimeoutFactor scales kimchi's internal timeouts in RaceMode.
+	raceTimeoutFactor = 4
+
+	// linkKeyFile is the name of a node's link key, within its data
+	// directory.
+	linkKeyFile = "link.private.pem"
+)
+
+var (
+	// ErrNodeNotFound is the error returned when no node has the requested
+	// identifier.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrNotAProvider is the error returned when a provider operation is
+	// requested for a mix.
+	ErrNotAProvider = errors.New("node is not a provider")
+
+	// ErrManagementDisabled is the error returned when a provider's
+	// management interface is required but is not enabled.
+	ErrManagementDisabled = errors.New("management interface is disabled")
 )
 
 var tailConfig = tail.Config{
@@ -64,31 +102,67 @@ type Kimchi struct {
 	sync.Mutex
 	sync.WaitGroup
 
-	baseDir   string
-	logWriter io.Writer
+	baseDir     string
+	tempBaseDir bool
+	logWriter   io.Writer
+	logBuffer   *logBuffer
+	logPaused   bool
+
+	extWhitelist *ExternalWhitelist
 
 	authConfig        *aConfig.Config
 	votingAuthConfigs []*vConfig.Config
 	authIdentity      *eddsa.PrivateKey
 	voting            bool
 	parameters        *Parameters
+	opts              Options
 	nVoting           int
 	nProvider         int
 	nMix              int
 
 	nodeConfigs []*sConfig.Config
-	lastPort    uint16
-	authPort    uint16
+	ports       map[portClass]*portRange
+	frontAddrs  map[string]string
 	nodeIdx     int
 	providerIdx int
 
 	recipients map[string]*ecdh.PublicKey
+	tags       map[string]map[string][]string
+
+	servers    []server
+	serverByID map[string]server
+	tails      []*tail.Tail
+
+	runStart       time.Time
+	startupTimings map[string]time.Duration
+	readyTimings   map[string]time.Duration
+
+	running  bool
+	haltCh   chan struct{}
+	ready    bool
+	readyFns []func()
+
+	lastMissing []string
+
+	prevGOMAXPROCS int
+
+	launchedConfigs map[string]string
 
-	servers []server
-	tails   []*tail.Tail
+	socksBridge  *socksBridge
+	faultProxies []*faultProxy
+
+	// The server constructors, which may be replaced by fakes in tests.
+	newNode               func(*sConfig.Config) (server, error)
+	newNonvotingAuthority func(*aConfig.Config) (server, error)
+	newVotingAuthority    func(*vConfig.Config) (server, error)
 }
 
-type server interface {
+// server is a running node or authority.
+type server = NodeServer
+
+// NodeServer is a running node, as returned by a replacement server
+// implementation set in Options.NodeServers.
+type NodeServer interface {
 	Shutdown()
 	Wait()
 }
@@ -97,200 +171,1140 @@ type Parameters struct {
 	vConfig.Parameters
 }
 
+// PortRange is the range of Size ports starting at Base.
+type PortRange struct {
+	Base uint16
+	Size uint16
+}
+
+// PortRanges are the port ranges used by each component class.
+type PortRanges struct {
+	Authority PortRange
+	Provider  PortRange
+	Mix       PortRange
+}
+
+type portClass int
+
+const (
+	authorityPorts portClass = iota
+	providerPorts
+	mixPorts
+)
+
+type portRange struct {
+	next, end int
+}
+
+// Options are the settings used to generate a kimchi network.
+type Options struct {
+	// BasePort is the first port allocated to the network.
+	BasePort int
+
+	// BaseDir is the directory holding every component's data directory.
+	// A temporary directory is created if it is empty.
+	BaseDir string
+
+	// TempRoot, if set, is the existing directory the temporary base
+	// directory is created in instead of the system default, such as a
+	// tmpfs mount.  It is ignored if BaseDir is set.
+	TempRoot string
+
+	// CleanStart removes any existing node and authority data
+	// directories in the base directory before generating their configs,
+	// so that keys and state left by an earlier run are not reused.  Only
+	// the component data directories are removed.
+	CleanStart bool
+
+	// PreserveData keeps a temporary base directory after Shutdown.
+	// kimchi never removes a base directory it did not create:
+	//
+	//	BaseDir   CleanStart  PreserveData  at start       at Shutdown
+	//	empty     (n/a)       false         new temp dir   removed
+	//	empty     (n/a)       true          new temp dir   kept
+	//	given     false       (n/a)         reused as is   kept
+	//	given     true        (n/a)         wiped          kept
+	PreserveData bool
+
+	// Parameters are the mix network parameters published by the
+	// authorities.
+	Parameters *Parameters
+
+	// Voting selects voting authorities instead of a nonvoting one.
+	Voting bool
+
+	// NVoting is the number of voting authorities.
+	NVoting int
+
+	// NProvider is the number of providers.
+	NProvider int
+
+	// NMix is the number of mixes.
+	NMix int
+
+	// Layers, if non-zero, is the number of mix layers the authorities
+	// arrange the mixes in.  It defaults to one layer per mix, up to 3.
+	// Providers are the first and last hop and are not part of a layer,
+	// so every layer needs at least one mix.
+	Layers int
+
+	// PortRanges, if set, allocates the ports of each component class
+	// from a dedicated range instead of sequentially from BasePort.
+	PortRanges *PortRanges
+
+	// LogBufferLines, if non-zero, additionally keeps that many of the
+	// most recent aggregate log lines in memory (see Logs).
+	LogBufferLines int
+
+	// AuthoritiesFirst launches the authorities before the nodes, instead
+	// of after them.  The authorities are listening by the time they are
+	// launched, so the nodes' first descriptor uploads succeed rather than
+	// logging connection errors until the authorities come up.
+	AuthoritiesFirst bool
+
+	// StartupTimeout, if non-zero, makes Run wait up to that long for the
+	// network to reach consensus before giving up and shutting it down.
+	StartupTimeout time.Duration
+
+	// ManagementDialTimeout is how long provider management commands keep
+	// retrying to connect while the provider starts up.  It defaults to 10
+	// seconds, and a negative value disables the retries.
+	ManagementDialTimeout time.Duration
+
+	// AuthorityRestarts, if non-zero, relaunches an authority from its
+	// config whenever it exits other than through Shutdown, up to that
+	// many times per authority.
+	AuthorityRestarts int
+
+	// Services override the capabilities and endpoints of the providers'
+	// built in Kaetzchen services.
+	Services Services
+
+	// Quiet is intended for benchmarks.  It sets every component's log
+	// level to ERROR, does not tail the component logs into the
+	// aggregate log, and writes the aggregate log only to its file.
+	Quiet bool
+
+	// LogRotation, if set, rotates the aggregate log.
+	LogRotation *LogRotation
+
+	// NodeOutputFiles additionally writes each component's tailed log
+	// lines to <identifier>.out in the base directory.  They are written
+	// even if Quiet is set.
+	NodeOutputFiles bool
+
+	// LogFilter, if set, is called with the identifier of the component
+	// and each line tailed from its log, and only the lines it returns
+	// true for are written to the aggregate log.  The lines written to the
+	// NodeOutputFiles are not filtered.  It is called concurrently for
+	// different components.
+	LogFilter func(node, line string) bool
+
+	// Keys are the long term keys to use for nodes and voting authorities,
+	// keyed by identifier (Eg: "node-0" or "authority-0.example.org").
+	// Keys that are not given are generated.  A node's link key is
+	// otherwise generated by the server, and a voting authority's is
+	// derived from its identity key.
+	Keys map[string]*Keys
+
+	// DisableManagement turns off the management interface of the
+	// providers it maps to true, keyed by identifier (Eg: "provider-0").
+	// Users can not be added to those providers.
+	DisableManagement map[string]bool
+
+	// NodeServers replace the server implementation of some nodes, keyed
+	// by identifier (Eg: "node-1"), for instance with a misbehaving mix.
+	// The configs are generated and whitelisted as for any other node, so
+	// the replacement must implement the server protocols itself.
+	NodeServers map[string]func(*sConfig.Config) (NodeServer, error)
+
+	// Workers are the worker counts of every node.
+	Workers Workers
+
+	// GOMAXPROCS, if non-zero, is set as the process' GOMAXPROCS while the
+	// network runs, and the previous value is restored by Shutdown.
+	GOMAXPROCS int
+
+	// RaceMode is intended for runs under the race detector.  It overrides
+	// Workers to run a single worker of each kind, and lengthens kimchi's
+	// internal timeouts (the default ManagementDialTimeout and the
+	// AssertNoLeaks grace period) by a factor of 4.  The component logs are
+	// always tailed by polling.
+	RaceMode bool
+
+	// WhitelistFile, if set, is a JSON file of additional providers and
+	// mixes, run outside of kimchi, for the authorities to whitelist along
+	// with the generated nodes (see ExternalWhitelist).
+	WhitelistFile string
+
+	// EnableRateLimit turns on the providers' per-client rate limiter,
+	// which is driven by Parameters.SendRatePerMinute.  It is off by
+	// default.
+	EnableRateLimit bool
+
+	// DisableDecoyTraffic stops every node from sending decoy traffic, so
+	// that packet traces are limited to client traffic.  Decoy traffic is
+	// sent by default.
+	DisableDecoyTraffic bool
+
+	// LogFiles overrides the log file names used by each component class.
+	LogFiles LogFiles
+
+	// Tags are the initial node tags, keyed by node identifier (Eg:
+	// "node-0") and then by tag key (see TagNode).
+	Tags map[string]map[string][]string
+
+	// MemspoolCommand, if set, is the path of a memspool plugin binary
+	// for the providers' spool service.  Otherwise memspool is built from
+	// its source in GOPATH into the base directory.
+	MemspoolCommand string
+
+	// SpoolBackend is the providers' spool backend.  The default, "bolt",
+	// keeps each spool on disk in the provider's data directory.  "sql"
+	// stores them in the PostgreSQL database at SQLDataSourceName.  The
+	// server has no purely in-memory spool.
+	SpoolBackend string
+
+	// SQLDataSourceName is the pgx data source used by the "sql" backend.
+	SQLDataSourceName string
+
+	// Faults, if set, routes all node and authority traffic through
+	// proxies that inject latency and connection loss.
+	Faults *FaultInjection
+
+	// GroupDataDirs places the data directories in "authorities",
+	// "providers" and "mixes" subdirectories of the base directory, and
+	// client files in "clients", instead of directly in it.
+	GroupDataDirs bool
+
+	// BindHost is the IP address every node and authority listens on.  It
+	// defaults to 127.0.0.1.
+	BindHost string
+
+	// AdvertiseHost, if set, is the IP address handed out for every node
+	// and authority in place of BindHost, in the published descriptors and
+	// in the authority addresses given to nodes, peers and clients.
+	AdvertiseHost string
+}
+
+// LogFiles are the log file names of each component class, relative to
+// the component's data directory.  Empty names keep the defaults.
+type LogFiles struct {
+	// Authority defaults to katzenpost.log for voting authorities and
+	// authority.log for the nonvoting authority.
+	Authority string
+
+	// Provider defaults to katzenpost.log.
+	Provider string
+
+	// Mix defaults to katzenpost.log.
+	Mix string
+
+	// Client defaults to katzenpost.log.
+	Client string
+}
+
+// Keys are the long term keys of a node or voting authority.
+type Keys struct {
+	IdentityKey *eddsa.PrivateKey
+	LinkKey     *ecdh.PrivateKey
+}
+
+// Workers are the number of packet processing workers of each kind run by
+// every node.  Zero values keep the server defaults, which for Sphinx
+// workers is the number of CPUs.
+type Workers struct {
+	Sphinx    int
+	Provider  int
+	Kaetzchen int
+}
+
+// Service is the capability and endpoint of a provider Kaetzchen service.
+type Service struct {
+	Capability string
+	Endpoint   string
+}
+
+// Services override the providers' built in Kaetzchen services.  Each
+// service must set both its capability and endpoint, or neither to keep
+// the defaults.
+type Services struct {
+	// Loop defaults to "loop" at "+loop".
+	Loop Service
+
+	// Keyserver defaults to "keyserver" at "+keyserver".
+	Keyserver Service
+
+	// Spool defaults to "spool" at "+spool".
+	Spool Service
+}
+
+func (s *Services) applyDefaults() {
+	for _, v := range []struct {
+		svc                  *Service
+		capability, endpoint string
+	}{
+		{&s.Loop, "loop", "+loop"},
+		{&s.Keyserver, "keyserver", "+keyserver"},
+		{&s.Spool, "spool", "+spool"},
+	} {
+		if v.svc.Capability == "" && v.svc.Endpoint == "" {
+			v.svc.Capability = v.capability
+			v.svc.Endpoint = v.endpoint
+		}
+	}
+}
+
+func (s *Services) validate() error {
+	capabilities := make(map[string]bool)
+	endpoints := make(map[string]bool)
+	for _, svc := range []Service{s.Loop, s.Keyserver, s.Spool} {
+		if svc.Capability == "" || svc.Endpoint == "" {
+			return fmt.Errorf("service '%v' at '%v' must set both a capability and an endpoint", svc.Capability, svc.Endpoint)
+		}
+		if svc.Endpoint != strings.ToLower(svc.Endpoint) {
+			return fmt.Errorf("service endpoint '%v' is not lower case", svc.Endpoint)
+		}
+		if capabilities[svc.Capability] || endpoints[svc.Endpoint] {
+			return fmt.Errorf("service '%v' at '%v' is not unique", svc.Capability, svc.Endpoint)
+		}
+		capabilities[svc.Capability] = true
+		endpoints[svc.Endpoint] = true
+	}
+	return nil
+}
+
+func logFileName(name, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
 // NewKimchi returns an initialized kimchi
 func NewKimchi(basePort int, baseDir string, parameters *Parameters, voting bool, nVoting, nProvider, nMix int) *Kimchi {
-	if parameters == nil {
-		parameters = &Parameters{}
+	k, err := NewKimchiWithOptions(Options{
+		BasePort:   basePort,
+		BaseDir:    baseDir,
+		Parameters: parameters,
+		Voting:     voting,
+		NVoting:    nVoting,
+		NProvider:  nProvider,
+		NMix:       nMix,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil
+	}
+	return k
+}
+
+// NewKimchiWithOptions returns an initialized kimchi.
+func NewKimchiWithOptions(opts Options) (*Kimchi, error) {
+	if opts.Parameters == nil {
+		opts.Parameters = &Parameters{}
+	}
+	ports, err := newPortRanges(opts.BasePort, opts.PortRanges)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port ranges: %w", err)
+	}
+	if opts.Faults != nil {
+		if err = opts.Faults.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.BindHost == "" {
+		opts.BindHost = "127.0.0.1"
+	}
+	for _, h := range []string{opts.BindHost, opts.AdvertiseHost} {
+		if h != "" && net.ParseIP(h) == nil {
+			return nil, fmt.Errorf("invalid host address: '%v'", h)
+		}
+	}
+	if opts.Layers < 0 || opts.Layers > maxLayers {
+		return nil, fmt.Errorf("invalid number of layers: %d", opts.Layers)
+	}
+	if opts.Workers.Sphinx < 0 || opts.Workers.Provider < 0 || opts.Workers.Kaetzchen < 0 || opts.GOMAXPROCS < 0 {
+		return nil, errors.New("invalid worker counts")
+	}
+	if opts.RaceMode {
+		opts.Workers = Workers{Sphinx: 1, Provider: 1, Kaetzchen: 1}
+		if opts.ManagementDialTimeout == 0 {
+			opts.ManagementDialTimeout = raceTimeoutFactor * defaultManagementDialTimeout
+		}
+	}
+	if opts.LogRotation != nil {
+		if err = opts.LogRotation.validate(); err != nil {
+			return nil, err
+		}
+	}
+	opts.Services.applyDefaults()
+	if err = opts.Services.validate(); err != nil {
+		return nil, err
+	}
+	switch opts.SpoolBackend {
+	case "", sConfig.BackendBolt:
+	case sConfig.BackendSQL:
+		if opts.SQLDataSourceName == "" {
+			return nil, errors.New("the sql spool backend requires SQLDataSourceName")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported spool backend: '%v'", opts.SpoolBackend)
 	}
 	k := &Kimchi{
-		lastPort:    uint16(basePort),
-		authPort:    uint16(basePort),
 		recipients:  make(map[string]*ecdh.PublicKey),
 		nodeConfigs: make([]*sConfig.Config, 0),
-		voting:      voting,
-		nVoting:     nVoting,
-		nProvider:   nProvider,
-		nMix:        nMix,
-		parameters:  parameters,
+		voting:      opts.Voting,
+		nVoting:     opts.NVoting,
+		nProvider:   opts.NProvider,
+		nMix:        opts.NMix,
+		parameters:  opts.Parameters,
+		opts:        opts,
+		ports:       ports,
+		frontAddrs:  make(map[string]string),
+
+		newNode: func(cfg *sConfig.Config) (server, error) {
+			if newFn := opts.NodeServers[cfg.Server.Identifier]; newFn != nil {
+				return newFn(cfg)
+			}
+			return nServer.New(cfg)
+		},
+		newNonvotingAuthority: func(cfg *aConfig.Config) (server, error) {
+			return aServer.New(cfg)
+		},
+		newVotingAuthority: func(cfg *vConfig.Config) (server, error) {
+			return vServer.New(cfg)
+		},
 	}
 	// Create the base directory and bring logging online.
-	var err error
-	if baseDir == "" {
-		k.baseDir, err = ioutil.TempDir("", "kimchi")
+	if opts.BaseDir == "" {
+		if opts.TempRoot != "" {
+			if fi, err := os.Stat(opts.TempRoot); err != nil {
+				return nil, fmt.Errorf("invalid temporary root: %w", err)
+			} else if !fi.IsDir() {
+				return nil, fmt.Errorf("invalid temporary root: '%v' is not a directory", opts.TempRoot)
+			}
+		}
+		k.baseDir, err = ioutil.TempDir(opts.TempRoot, "kimchi")
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create base directory: %v\n", err)
-			os.Exit(-1)
+			return nil, fmt.Errorf("failed to create base directory: %w", err)
 		}
+		k.tempBaseDir = true
 	} else {
-		k.baseDir = baseDir
+		k.baseDir = opts.BaseDir
 	}
 	if err = k.initLogging(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
-		os.Exit(-1)
+		return nil, fmt.Errorf("failed to initialize logging: %w", err)
+	}
+	if opts.WhitelistFile != "" {
+		if k.extWhitelist, err = loadWhitelistFile(opts.WhitelistFile); err != nil {
+			return nil, err
+		}
 	}
 	if err = k.initConfig(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to initConfig(): %v", err)
-		return nil
+		return nil, fmt.Errorf("failed to initConfig(): %w", err)
 	}
-	return k
+	for id, tags := range opts.Tags {
+		for key, vals := range tags {
+			for _, val := range vals {
+				k.TagNode(id, key, val)
+			}
+		}
+	}
+	return k, nil
 }
 
-func (k *Kimchi) Run() {
-	// Launch all the nodes.
+func newPortRanges(basePort int, r *PortRanges) (map[portClass]*portRange, error) {
+	if r == nil {
+		// Every class shares the one sequential allocator.
+		p := &portRange{next: basePort, end: 65536}
+		return map[portClass]*portRange{
+			authorityPorts: p,
+			providerPorts:  p,
+			mixPorts:       p,
+		}, nil
+	}
+	ports := make(map[portClass]*portRange)
+	for c, v := range map[portClass]PortRange{
+		authorityPorts: r.Authority,
+		providerPorts:  r.Provider,
+		mixPorts:       r.Mix,
+	} {
+		p := &portRange{next: int(v.Base), end: int(v.Base) + int(v.Size)}
+		if v.Size == 0 || p.end > 65536 {
+			return nil, fmt.Errorf("invalid port range: %v+%v", v.Base, v.Size)
+		}
+		for _, o := range ports {
+			if p.next < o.end && o.next < p.end {
+				return nil, fmt.Errorf("port range %v+%v overlaps another range", v.Base, v.Size)
+			}
+		}
+		ports[c] = p
+	}
+	return ports, nil
+}
+
+// nextAddress allocates the next listen address for the component class.
+func (k *Kimchi) nextAddress(c portClass) (string, error) {
+	p := k.ports[c]
+	if p.next >= p.end {
+		return "", fmt.Errorf("port range exhausted at %d", p.end)
+	}
+	addr := net.JoinHostPort(k.opts.BindHost, strconv.Itoa(p.next))
+	p.next++
+	return addr, nil
+}
+
+// Run launches every node and authority.  If any of them fails to launch,
+// the ones already started are shut down and the error is returned.
+func (k *Kimchi) Run() error {
+	if k.opts.StartupTimeout == 0 {
+		if err := k.claim(); err != nil {
+			return err
+		}
+		return k.launch()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k.opts.StartupTimeout)
+	defer cancel()
+	return k.RunContext(ctx)
+}
+
+// RunContext launches the network like Run, and then waits for it to reach
+// consensus.  If the context is done first, everything is shut down and
+// the returned error names the components that never became ready.
+func (k *Kimchi) RunContext(ctx context.Context) error {
+	if err := k.claim(); err != nil {
+		return err
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- k.launch()
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		// Stop the launch at the next server, and wait for it to return
+		// so that nothing is started after the teardown.  A failed launch
+		// has already halted the network.
+		k.Lock()
+		k.closeHaltCh()
+		k.Unlock()
+		if err := <-errCh; err == nil {
+			k.halt()
+		}
+		return k.startupError(ctx.Err())
+	}
+	if _, err := k.WaitForReady(ctx); err != nil {
+		err = k.startupError(err)
+		k.halt()
+		return err
+	}
+	return nil
+}
+
+// claim marks the network as running, or fails if it already is.
+func (k *Kimchi) claim() error {
+	k.Lock()
+	defer k.Unlock()
+	if k.running {
+		return errors.New("already running")
+	}
+	k.running = true
+	k.ready = false
+	k.runStart = time.Now()
+	k.startupTimings = make(map[string]time.Duration)
+	k.readyTimings = make(map[string]time.Duration)
+	k.haltCh = make(chan struct{})
+	if k.opts.GOMAXPROCS > 0 {
+		k.prevGOMAXPROCS = runtime.GOMAXPROCS(k.opts.GOMAXPROCS)
+	}
+	return nil
+}
+
+// launch starts the network claimed by claim.  If anything fails to start,
+// the network is halted.
+func (k *Kimchi) launch() error {
+	k.Lock()
+	haltCh := k.haltCh
+	k.Unlock()
+
+	if err := k.startFaultProxies(); err != nil {
+		k.halt()
+		return err
+	}
+
+	phases := []func() error{k.launchNodes, k.runAuthority}
+	if k.opts.AuthoritiesFirst {
+		phases[0], phases[1] = phases[1], phases[0]
+	}
+	for _, fn := range phases {
+		if err := fn(); err != nil {
+			k.halt()
+			return err
+		}
+	}
+	// Register with the WaitGroup before spawning, so that a racing halt
+	// still waits for the watcher.
+	k.Add(1)
+	go k.consensusWatcher(haltCh)
+	return nil
+}
+
+// launchNodes launches all the nodes.
+func (k *Kimchi) launchNodes() error {
 	for _, v := range k.nodeConfigs {
 		v.FixupAndValidate()
-		svr, err := nServer.New(v)
+		svr, err := k.launchNode(v)
 		if err != nil {
-			log.Fatalf("Failed to launch node: %v", err)
+			return fmt.Errorf("failed to launch node %v: %w", v.Server.Identifier, err)
+		}
+		if err = k.addServer(v.Server.Identifier, svr); err != nil {
+			return err
+		}
+		k.startLogTailer(v.Server.Identifier, filepath.Join(v.Server.DataDir, v.Logging.File))
+	}
+	return nil
+}
+
+// addServer records a newly launched server.  If the network was halted
+// while the server was being launched, it is shut down instead.
+func (k *Kimchi) addServer(identifier string, svr server) error {
+	k.Lock()
+	select {
+	case <-k.haltCh:
+		k.Unlock()
+		svr.Shutdown()
+		return errors.New("network was shut down during startup")
+	default:
+	}
+	k.servers = append(k.servers, svr)
+	if k.serverByID == nil {
+		k.serverByID = make(map[string]server)
+	}
+	k.serverByID[identifier] = svr
+	if k.startupTimings != nil {
+		k.startupTimings[identifier] = time.Since(k.runStart)
+	}
+	k.Unlock()
+	return nil
+}
+
+// startupError annotates err with the components that were never launched
+// or that were missing from the last consensus.
+func (k *Kimchi) startupError(err error) error {
+	k.Lock()
+	defer k.Unlock()
+	var pending []string
+	for _, id := range k.componentIdentifiers() {
+		if _, ok := k.startupTimings[id]; !ok {
+			pending = append(pending, id)
 		}
+	}
+	if len(pending) == 0 {
+		pending = k.lastMissing
+	}
+	return fmt.Errorf("network not ready, waiting on %v: %w", pending, err)
+}
 
-		k.servers = append(k.servers, svr)
-		go k.LogTailer(v.Server.Identifier, filepath.Join(v.Server.DataDir, v.Logging.File))
+// componentIdentifiers returns the identifiers of every node and authority.
+func (k *Kimchi) componentIdentifiers() []string {
+	ids := k.nodeIdentifiers()
+	if k.voting {
+		for _, aCfg := range k.votingAuthConfigs {
+			ids = append(ids, aCfg.Authority.Identifier)
+		}
+	} else {
+		ids = append(ids, "nonvoting")
 	}
-	k.runAuthority()
+	return ids
 }
 
 func (k *Kimchi) initConfig() error {
+	if err := k.checkTopology(); err != nil {
+		return err
+	}
+
 	// Generate the authority configs
 	var err error
 	if k.voting {
-		err = k.genVotingAuthoritiesCfg()
-		if err != nil {
-			log.Fatalf("getVotingAuthoritiesCfg failed: %s", err)
+		if err = k.genVotingAuthoritiesCfg(); err != nil {
+			return fmt.Errorf("failed to generate voting authority configs: %w", err)
 		}
 	} else {
 		if err = k.genAuthConfig(); err != nil {
-			log.Fatalf("Failed to generate authority config: %v", err)
+			return fmt.Errorf("failed to generate authority config: %w", err)
 		}
 	}
 
 	// Generate the provider configs.
 	for i := 0; i < k.nProvider; i++ {
 		if err = k.genNodeConfig(true, k.voting); err != nil {
-			log.Fatalf("Failed to generate provider config: %v", err)
+			return fmt.Errorf("failed to generate provider config: %w", err)
 		}
 	}
 
-	err = k.buildMemspool()
-	if err != nil {
-		panic(err)
+	if k.opts.MemspoolCommand == "" {
+		if err = k.buildMemspool(); err != nil {
+			return fmt.Errorf("failed to build memspool: %w", err)
+		}
 	}
 
 	// Generate the node configs.
 	for i := 0; i < k.nMix; i++ {
 		if err = k.genNodeConfig(false, k.voting); err != nil {
-			log.Fatalf("Failed to generate node config: %v", err)
+			return fmt.Errorf("failed to generate node config: %w", err)
 		}
 	}
 
 	// Generate the node lists.
+	if err = k.updateWhitelists(); err != nil {
+		return fmt.Errorf("failed to generate whitelists: %w", err)
+	}
+	return k.checkDataDirs()
+}
+
+// updateWhitelists regenerates the authority node lists from the node
+// configs.
+func (k *Kimchi) updateWhitelists() error {
 	if k.voting {
 		providerWhitelist, mixWhitelist, err := k.generateVotingWhitelist()
 		if err != nil {
-			panic(err)
+			return err
 		}
 		for _, aCfg := range k.votingAuthConfigs {
 			aCfg.Mixes = mixWhitelist
 			aCfg.Providers = providerWhitelist
 		}
-	} else {
-		if providers, mixes, err := k.generateWhitelist(); err == nil {
-			k.authConfig.Mixes = mixes
-			k.authConfig.Providers = providers
-		} else {
-			log.Fatalf("Failed to generateWhitelist with %s", err)
-		}
+		return nil
 	}
-	return err
+	providers, mixes, err := k.generateWhitelist()
+	if err != nil {
+		return err
+	}
+	k.authConfig.Mixes = mixes
+	k.authConfig.Providers = providers
+	return nil
 }
 
-func (k *Kimchi) runAuthority() {
-	var err error
-	if k.voting {
-		err = k.runVotingAuthorities()
-	} else {
-		err = k.runNonvoting()
+// AddMix generates an additional mix and adds it to the authority
+// whitelists.  If the network is running, the mix is launched and, as the
+// authorities only read their whitelists at launch, they are restarted one
+// at a time to admit it.  Otherwise the mix is launched by the next Run.
+func (k *Kimchi) AddMix() (*sConfig.Config, error) {
+	k.Lock()
+	running := k.running
+	nConfigs := len(k.nodeConfigs)
+	nProxies := len(k.faultProxies)
+	if err := k.genNodeConfig(false, k.voting); err != nil {
+		k.removeMix(nil, k.faultProxies[nProxies:])
+		k.Unlock()
+		return nil, err
+	}
+	cfg := k.nodeConfigs[nConfigs]
+	proxies := append([]*faultProxy{}, k.faultProxies[nProxies:]...)
+	k.nMix++
+	if err := k.updateWhitelists(); err != nil {
+		k.removeMix(cfg, proxies)
+		k.Unlock()
+		return nil, err
+	}
+	k.Unlock()
+	if !running {
+		return cfg, nil
+	}
+
+	fail := func(err error) (*sConfig.Config, error) {
+		if svr, ok := k.removeServer(cfg.Server.Identifier); ok {
+			svr.Shutdown()
+		}
+		k.Lock()
+		k.removeMix(cfg, proxies)
+		k.Unlock()
+		return nil, err
+	}
+	for _, p := range proxies {
+		if err := k.startFaultProxy(p); err != nil {
+			return fail(fmt.Errorf("failed to start fault proxy for %v: %w", cfg.Server.Identifier, err))
+		}
 	}
+	svr, err := k.launchNode(cfg)
 	if err != nil {
-		panic(err)
+		return fail(fmt.Errorf("failed to launch node %v: %w", cfg.Server.Identifier, err))
+	}
+	if err = k.addServer(cfg.Server.Identifier, svr); err != nil {
+		return fail(err)
 	}
+	if err = k.restartAuthorities(); err != nil {
+		return fail(err)
+	}
+	k.startLogTailer(cfg.Server.Identifier, filepath.Join(cfg.Server.DataDir, cfg.Logging.File))
+	return cfg, nil
 }
 
-func (k *Kimchi) PKIClient() (pki.Client, error) {
-	b, err := klog.New("", "DEBUG", false)
-	if err != nil {
-		return nil, err
+// removeMix undoes a partially added mix, forgetting its config, if any,
+// and stopping and forgetting its fault proxies, and regenerates the
+// whitelists without it.  The caller must hold the lock.
+func (k *Kimchi) removeMix(cfg *sConfig.Config, proxies []*faultProxy) {
+	for _, p := range proxies {
+		k.stopFaultProxy(p)
+		delete(k.frontAddrs, p.backend)
+		for i, v := range k.faultProxies {
+			if v == p {
+				k.faultProxies = append(k.faultProxies[:i], k.faultProxies[i+1:]...)
+				break
+			}
+		}
 	}
-	if k.voting {
-		p, err := sConfig.AuthorityPeersFromPeers(k.votingPeers())
-		if err != nil {
-			return nil, err
+	if cfg == nil {
+		return
+	}
+	for i, v := range k.nodeConfigs {
+		if v == cfg {
+			k.nodeConfigs = append(k.nodeConfigs[:i], k.nodeConfigs[i+1:]...)
+			k.nMix--
+			break
 		}
-		cfg := vClient.Config{LogBackend: b, Authorities: p}
-		return vClient.New(&cfg)
 	}
-	cfg := nvClient.Config{LogBackend: b, Address: k.authConfig.Authority.Addresses[0], PublicKey: k.authConfig.Debug.IdentityKey.PublicKey()}
-	return nvClient.New(&cfg)
+	for _, addr := range cfg.Server.Addresses {
+		delete(k.frontAddrs, addr)
+	}
+	if err := k.updateWhitelists(); err != nil {
+		log.Printf("Failed to regenerate the whitelists without %v: %v", cfg.Server.Identifier, err)
+	}
 }
 
-func (k *Kimchi) initLogging() error {
-	logFilePath := filepath.Join(k.baseDir, logFile)
-	f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
+// KillNode stops the named node.  The in-process server can only be stopped
+// through its Shutdown, but as nodes never withdraw their descriptors, peers
+// and the authorities see the node vanish just as they would after a crash.
+func (k *Kimchi) KillNode(identifier string) error {
+	if _, err := k.nodeConfig(identifier); err != nil {
 		return err
 	}
+	svr, ok := k.removeServer(identifier)
+	if !ok {
+		return fmt.Errorf("%v is not running", identifier)
+	}
 
-	// Log to both stdout *and* the log file.
-	k.logWriter = io.MultiWriter(f, os.Stdout)
-	log.SetOutput(k.logWriter)
-
+	log.Printf("Killing %v", identifier)
+	svr.Shutdown()
 	return nil
 }
 
-func (k *Kimchi) genVotingAuthoritiesCfg() error {
-	// create voting config.Parameters from generic parameters
-	parameters := &vConfig.Parameters{
-		SendRatePerMinute: k.parameters.SendRatePerMinute,
-		Mu:                k.parameters.Mu,
-		MuMaxDelay:        k.parameters.MuMaxDelay,
-		LambdaP:           k.parameters.LambdaP,
-		LambdaPMaxDelay:   k.parameters.LambdaPMaxDelay,
-		LambdaL:           k.parameters.LambdaL,
-		LambdaLMaxDelay:   k.parameters.LambdaLMaxDelay,
+// removeServer stops tracking the named server and returns it.
+func (k *Kimchi) removeServer(identifier string) (server, bool) {
+	k.Lock()
+	defer k.Unlock()
+	svr, ok := k.serverByID[identifier]
+	if !ok {
+		return nil, false
 	}
-	configs := []*vConfig.Config{}
-
-	// initial generation of key material for each authority
-	peersMap := make(map[[eddsa.PublicKeySize]byte]*vConfig.AuthorityPeer)
-	for i := 0; i < k.nVoting; i++ {
-		cfg := new(vConfig.Config)
-		cfg.Logging = &vConfig.Logging{
-			Disable: false,
-			File:    "katzenpost.log",
-			Level:   "DEBUG",
-		}
-		cfg.Parameters = parameters
-		cfg.Authority = &vConfig.Authority{
-			Identifier: fmt.Sprintf("authority-%v.example.org", i),
-			Addresses:  []string{fmt.Sprintf("127.0.0.1:%d", k.lastPort)},
-			DataDir:    filepath.Join(k.baseDir, fmt.Sprintf("authority%d", i)),
-		}
-		k.lastPort++
-		if err := os.Mkdir(cfg.Authority.DataDir, 0700); err != nil {
-			return err
+	delete(k.serverByID, identifier)
+	for i, v := range k.servers {
+		if v == svr {
+			k.servers = append(k.servers[:i], k.servers[i+1:]...)
+			break
 		}
-		idKey, err := eddsa.NewKeypair(rand.Reader)
+	}
+	return svr, true
+}
+
+// replaceServer shuts down the named server, if it is running, and
+// launches a new one in its place with newFn.
+func (k *Kimchi) replaceServer(identifier string, newFn func() (server, error)) error {
+	if svr, ok := k.removeServer(identifier); ok {
+		svr.Shutdown()
+	}
+	log.Printf("Restarting %v", identifier)
+	svr, err := newFn()
+	if err != nil {
+		return fmt.Errorf("failed to launch %v: %w", identifier, err)
+	}
+	return k.addServer(identifier, svr)
+}
+
+// RestartNode relaunches a node stopped by KillNode from its config and
+// data directory.
+func (k *Kimchi) RestartNode(identifier string) error {
+	cfg, err := k.nodeConfig(identifier)
+	if err != nil {
+		return err
+	}
+	k.Lock()
+	_, ok := k.serverByID[identifier]
+	running := k.running
+	k.Unlock()
+	if !running {
+		return errors.New("network is not running")
+	}
+	if ok {
+		return fmt.Errorf("%v is already running", identifier)
+	}
+
+	return k.replaceServer(identifier, func() (server, error) {
+		return k.launchNode(cfg)
+	})
+}
+
+// dataDir returns the path of the named component's data directory,
+// creating its group directory if Options.GroupDataDirs is set.
+func (k *Kimchi) dataDir(group, name string) (string, error) {
+	if !k.opts.GroupDataDirs {
+		return filepath.Join(k.baseDir, name), nil
+	}
+	dir := filepath.Join(k.baseDir, group)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// componentDataDir returns the path of a node or authority data directory,
+// first removing it if Options.CleanStart is set.
+func (k *Kimchi) componentDataDir(group, name string) (string, error) {
+	dir, err := k.dataDir(group, name)
+	if err != nil {
+		return "", err
+	}
+	if k.opts.CleanStart {
+		if err = os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// checkDataDirs ensures that no two components share a data directory.
+func (k *Kimchi) checkDataDirs() error {
+	dirs := make(map[string]string)
+	add := func(identifier, dir string) error {
+		dir = filepath.Clean(dir)
+		if other, ok := dirs[dir]; ok {
+			return fmt.Errorf("%v and %v share the data directory %v", other, identifier, dir)
+		}
+		dirs[dir] = identifier
+		return nil
+	}
+	if k.voting {
+		for _, aCfg := range k.votingAuthConfigs {
+			if err := add(aCfg.Authority.Identifier, aCfg.Authority.DataDir); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := add("nonvoting", k.authConfig.Authority.DataDir); err != nil {
+			return err
+		}
+	}
+	for _, nodeCfg := range k.nodeConfigs {
+		if err := add(nodeCfg.Server.Identifier, nodeCfg.Server.DataDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Kimchi) runAuthority() error {
+	if k.voting {
+		return k.runVotingAuthorities()
+	}
+	return k.runNonvoting()
+}
+
+func (k *Kimchi) PKIClient() (pki.Client, error) {
+	b, err := klog.New("", k.logLevel(), false)
+	if err != nil {
+		return nil, err
+	}
+	if k.voting {
+		p, err := sConfig.AuthorityPeersFromPeers(k.votingPeers())
+		if err != nil {
+			return nil, err
+		}
+		cfg := vClient.Config{LogBackend: b, Authorities: p}
+		return vClient.New(&cfg)
+	}
+	nvAuth := k.NonvotingAuthority()
+	cfg := nvClient.Config{LogBackend: b, Address: nvAuth.Address, PublicKey: nvAuth.PublicKey}
+	return nvClient.New(&cfg)
+}
+
+func (k *Kimchi) initLogging() error {
+	logFilePath := filepath.Join(k.baseDir, logFile)
+	var f io.Writer
+	var err error
+	if k.opts.LogRotation != nil {
+		f, err = newRotatingFile(logFilePath, *k.opts.LogRotation)
+	} else {
+		f, err = os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Log to both stdout *and* the log file.
+	k.logWriter = io.MultiWriter(f, os.Stdout)
+	if k.opts.Quiet {
+		k.logWriter = f
+	}
+	if k.opts.LogBufferLines > 0 {
+		k.logBuffer = newLogBuffer(k.opts.LogBufferLines)
+		k.logWriter = io.MultiWriter(k.logWriter, k.logBuffer)
+	}
+	log.SetOutput(k.logWriter)
+
+	return nil
+}
+
+// logLevel returns the log level of every component.
+func (k *Kimchi) logLevel() string {
+	if k.opts.Quiet {
+		return "ERROR"
+	}
+	return "DEBUG"
+}
+
+// votingParameters creates voting config.Parameters from generic parameters.
+func (k *Kimchi) votingParameters() *vConfig.Parameters {
+	return &vConfig.Parameters{
+		SendRatePerMinute: k.parameters.SendRatePerMinute,
+		Mu:                k.parameters.Mu,
+		MuMaxDelay:        k.parameters.MuMaxDelay,
+		LambdaP:           k.parameters.LambdaP,
+		LambdaPMaxDelay:   k.parameters.LambdaPMaxDelay,
+		LambdaL:           k.parameters.LambdaL,
+		LambdaLMaxDelay:   k.parameters.LambdaLMaxDelay,
+	}
+}
+
+// nonvotingParameters creates nonvoting config.Parameters from generic
+// parameters.
+func (k *Kimchi) nonvotingParameters() *aConfig.Parameters {
+	return &aConfig.Parameters{
+		SendRatePerMinute: k.parameters.SendRatePerMinute,
+		Mu:                k.parameters.Mu,
+		MuMaxDelay:        k.parameters.MuMaxDelay,
+		LambdaP:           k.parameters.LambdaP,
+		LambdaPMaxDelay:   k.parameters.LambdaPMaxDelay,
+		LambdaL:           k.parameters.LambdaL,
+		LambdaLMaxDelay:   k.parameters.LambdaLMaxDelay,
+	}
+}
+
+// SetMixParameters changes the mix network parameters published by the
+// authorities.  The authorities can not reload their config, so running
+// authorities are restarted one at a time.  The consensus already made for
+// the current epoch is unchanged; the new parameters are published from
+// the next consensus the restarted authorities make.
+func (k *Kimchi) SetMixParameters(p *Parameters) error {
+	if p == nil {
+		return errors.New("mix parameters are nil")
+	}
+
+	k.Lock()
+	k.parameters = p
+	k.opts.Parameters = p
+	running := k.running
+	if !k.voting {
+		a := k.authConfig
+		a.Parameters = k.nonvotingParameters()
+		if err := a.FixupAndValidate(); err != nil {
+			k.Unlock()
+			return err
+		}
+	} else {
+		for _, vCfg := range k.votingAuthConfigs {
+			vCfg.Parameters = k.votingParameters()
+			if err := vCfg.FixupAndValidate(); err != nil {
+				k.Unlock()
+				return err
+			}
+		}
+	}
+	k.Unlock()
+	if !running {
+		return nil
+	}
+	return k.restartAuthorities()
+}
+
+// restartAuthorities relaunches every authority from its config, one at a
+// time, so that a running network picks up changes to the authority
+// configs.
+func (k *Kimchi) restartAuthorities() error {
+	if !k.voting {
+		a := k.authConfig
+		if err := a.FixupAndValidate(); err != nil {
+			return err
+		}
+		return k.replaceServer("nonvoting", func() (server, error) {
+			return k.newAuthority("nonvoting", func() (server, error) {
+				return k.newNonvotingAuthority(a)
+			})
+		})
+	}
+	for _, vCfg := range k.votingAuthConfigs {
+		if err := vCfg.FixupAndValidate(); err != nil {
+			return err
+		}
+	}
+	for _, vCfg := range k.votingAuthConfigs {
+		cfg := vCfg
+		id := cfg.Authority.Identifier
+		err := k.replaceServer(id, func() (server, error) {
+			return k.newAuthority(id, func() (server, error) {
+				return k.newVotingAuthority(cfg)
+			})
+		})
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
+func (k *Kimchi) genVotingAuthoritiesCfg() error {
+	parameters := k.votingParameters()
+	configs := []*vConfig.Config{}
+
+	// initial generation of key material for each authority
+	peersMap := make(map[[eddsa.PublicKeySize]byte]*vConfig.AuthorityPeer)
+	for i := 0; i < k.nVoting; i++ {
+		addr, err := k.nextAddress(authorityPorts)
+		if err != nil {
+			return err
+		}
+		if _, err = k.frontAddress(authorityPorts, addr); err != nil {
+			return err
+		}
+		cfg := new(vConfig.Config)
+		cfg.Logging = &vConfig.Logging{
+			Disable: false,
+			File:    logFileName(k.opts.LogFiles.Authority, "katzenpost.log"),
+			Level:   k.logLevel(),
+		}
+		cfg.Parameters = parameters
+		cfg.Authority = &vConfig.Authority{
+			Identifier: fmt.Sprintf("authority-%v.example.org", i),
+			Addresses:  []string{addr},
+		}
+		cfg.Authority.DataDir, err = k.componentDataDir("authorities", fmt.Sprintf("authority%d", i))
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(cfg.Authority.DataDir, 0700); err != nil {
+			return err
+		}
+		idKey, linkKey, err := k.authorityKeys(cfg.Authority.Identifier)
 		if err != nil {
 			return err
 		}
 		cfg.Debug = &vConfig.Debug{
 			IdentityKey:      idKey,
-			LinkKey:          idKey.ToECDH(),
-			Layers:           3,
+			LinkKey:          linkKey,
+			Layers:           k.layers(),
 			MinNodesPerLayer: 1,
 			GenerateOnly:     false,
 		}
@@ -298,7 +1312,7 @@ func (k *Kimchi) genVotingAuthoritiesCfg() error {
 		authorityPeer := &vConfig.AuthorityPeer{
 			IdentityPublicKey: cfg.Debug.IdentityKey.PublicKey(),
 			LinkPublicKey:     cfg.Debug.LinkKey.PublicKey(),
-			Addresses:         cfg.Authority.Addresses,
+			Addresses:         k.advertisedAddresses(cfg.Authority.Addresses),
 		}
 		peersMap[cfg.Debug.IdentityKey.PublicKey().ByteArray()] = authorityPeer
 	}
@@ -317,6 +1331,113 @@ func (k *Kimchi) genVotingAuthoritiesCfg() error {
 	return nil
 }
 
+// authorityKeys returns the identity and link keys of the named voting
+// authority.  Unless set in Options.Keys, the identity key is generated
+// and the link key is derived from it.
+func (k *Kimchi) authorityKeys(identifier string) (*eddsa.PrivateKey, *ecdh.PrivateKey, error) {
+	keys := k.opts.Keys[identifier]
+	if keys == nil {
+		keys = new(Keys)
+	}
+	idKey := keys.IdentityKey
+	if idKey == nil {
+		var err error
+		if idKey, err = eddsa.NewKeypair(rand.Reader); err != nil {
+			return nil, nil, err
+		}
+	}
+	linkKey := keys.LinkKey
+	if linkKey == nil {
+		linkKey = idKey.ToECDH()
+	}
+	return idKey, linkKey, nil
+}
+
+// writeLinkKey stores a node's link key in its data directory, where the
+// server loads it from instead of generating one.
+func writeLinkKey(dataDir string, linkKey *ecdh.PrivateKey) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	blk := &pem.Block{
+		Type:  "X25519 PRIVATE KEY",
+		Bytes: linkKey.Bytes(),
+	}
+	return ioutil.WriteFile(filepath.Join(dataDir, linkKeyFile), pem.EncodeToMemory(blk), 0600)
+}
+
+// checkTopology ensures that the authorities can arrange the nodes into a
+// usable topology, with providers as the first and last hop and every mix
+// layer in between populated.
+func (k *Kimchi) checkTopology() error {
+	// The authorities require at least one mix layer, so a provider only
+	// network can not reach consensus.
+	if k.nMix < 1 {
+		return errors.New("at least one mix is required")
+	}
+	if k.nProvider < 1 {
+		return errors.New("at least one provider is required as the first and last hop")
+	}
+	if k.nMix < k.layers() {
+		return fmt.Errorf("%d layers requested, but there are only %d mixes to fill them", k.layers(), k.nMix)
+	}
+	return nil
+}
+
+// layers returns the number of mix layers, Options.Layers if set and
+// otherwise the maximum, reduced for networks with fewer mixes than that.
+func (k *Kimchi) layers() int {
+	if k.opts.Layers > 0 {
+		return k.opts.Layers
+	}
+	if k.nMix < maxLayers {
+		return k.nMix
+	}
+	return maxLayers
+}
+
+// IsVoting returns true iff the network uses voting authorities.
+func (k *Kimchi) IsVoting() bool {
+	return k.voting
+}
+
+// NumAuthorities returns the number of authorities in the network.
+func (k *Kimchi) NumAuthorities() int {
+	if k.voting {
+		return len(k.votingAuthConfigs)
+	}
+	return 1
+}
+
+// AuthorityPeers returns the public identity, link key and addresses of
+// each voting authority, or nil for a nonvoting network.
+func (k *Kimchi) AuthorityPeers() []*vConfig.AuthorityPeer {
+	if !k.voting {
+		return nil
+	}
+	peers := make([]*vConfig.AuthorityPeer, 0, len(k.votingAuthConfigs))
+	for _, aCfg := range k.votingAuthConfigs {
+		peers = append(peers, &vConfig.AuthorityPeer{
+			IdentityPublicKey: aCfg.Debug.IdentityKey.PublicKey(),
+			LinkPublicKey:     aCfg.Debug.LinkKey.PublicKey(),
+			Addresses:         k.advertisedAddresses(aCfg.Authority.Addresses),
+		})
+	}
+	return peers
+}
+
+// NonvotingAuthority returns the address and public key of the nonvoting
+// authority, or nil for a voting network.
+func (k *Kimchi) NonvotingAuthority() *cConfig.NonvotingAuthority {
+	if k.voting {
+		return nil
+	}
+	return &cConfig.NonvotingAuthority{
+		Address:   k.advertisedAddresses(k.authConfig.Authority.Addresses)[0],
+		PublicKey: k.authIdentity.PublicKey(),
+	}
+}
+
 func (k *Kimchi) votingPeers() []*sConfig.Peer {
 	peers := []*sConfig.Peer{}
 	for _, peer := range k.votingAuthConfigs {
@@ -329,7 +1450,7 @@ func (k *Kimchi) votingPeers() []*sConfig.Peer {
 			continue
 		}
 		p := &sConfig.Peer{
-			Addresses:         peer.Authority.Addresses,
+			Addresses:         k.advertisedAddresses(peer.Authority.Addresses),
 			IdentityPublicKey: string(idKey),
 			LinkPublicKey:     string(linkKey),
 		}
@@ -341,6 +1462,14 @@ func (k *Kimchi) votingPeers() []*sConfig.Peer {
 	return peers
 }
 
+// memspoolCommand returns the path of the memspool plugin binary.
+func (k *Kimchi) memspoolCommand() string {
+	if k.opts.MemspoolCommand != "" {
+		return k.opts.MemspoolCommand
+	}
+	return path.Join(k.baseDir, "memspool")
+}
+
 func (k *Kimchi) buildMemspool() error {
 	cmd := exec.Command("go", "build", "-o", path.Join(k.baseDir, "memspool"))
 	cmd.Dir = path.Join(os.Getenv("GOPATH"), "src/github.com/katzenpost/memspool/server")
@@ -348,33 +1477,68 @@ func (k *Kimchi) buildMemspool() error {
 }
 
 func (k *Kimchi) genNodeConfig(isProvider bool, isVoting bool) error {
-	const serverLogFile = "katzenpost.log"
-
 	n := fmt.Sprintf("node-%d", k.nodeIdx)
+	class := mixPorts
 	if isProvider {
 		n = fmt.Sprintf("provider-%d", k.providerIdx)
+		class = providerPorts
+	}
+	addr, err := k.nextAddress(class)
+	if err != nil {
+		return err
 	}
 	cfg := new(sConfig.Config)
 
 	// Server section.
 	cfg.Server = new(sConfig.Server)
 	cfg.Server.Identifier = n
-	cfg.Server.Addresses = []string{fmt.Sprintf("127.0.0.1:%d", k.lastPort)}
-	cfg.Server.DataDir = filepath.Join(k.baseDir, n)
+	cfg.Server.Addresses = []string{addr}
+	if front, err := k.frontAddress(class, addr); err != nil {
+		return err
+	} else if front != addr {
+		cfg.Server.AltAddresses = map[string][]string{
+			string(addressTransport(front)): []string{front},
+		}
+		cfg.Server.OnlyAdvertiseAltAddresses = true
+	}
+	group := "mixes"
+	if isProvider {
+		group = "providers"
+	}
+	if cfg.Server.DataDir, err = k.componentDataDir(group, n); err != nil {
+		return err
+	}
 	cfg.Server.IsProvider = isProvider
 
 	// Logging section.
 	cfg.Logging = new(sConfig.Logging)
-	cfg.Logging.File = serverLogFile
-	cfg.Logging.Level = "DEBUG"
+	cfg.Logging.File = logFileName(k.opts.LogFiles.Mix, "katzenpost.log")
+	if isProvider {
+		cfg.Logging.File = logFileName(k.opts.LogFiles.Provider, "katzenpost.log")
+	}
+	cfg.Logging.Level = k.logLevel()
 
 	// Debug section.
 	cfg.Debug = new(sConfig.Debug)
-	cfg.Debug.DisableRateLimit = true
+	cfg.Debug.DisableRateLimit = !k.opts.EnableRateLimit
+	cfg.Debug.SendDecoyTraffic = !k.opts.DisableDecoyTraffic
+	cfg.Debug.NumSphinxWorkers = k.opts.Workers.Sphinx
+	cfg.Debug.NumProviderWorkers = k.opts.Workers.Provider
+	cfg.Debug.NumKaetzchenWorkers = k.opts.Workers.Kaetzchen
 	identity, err := eddsa.NewKeypair(rand.Reader)
 	if err != nil {
 		return err
 	}
+	if keys := k.opts.Keys[n]; keys != nil {
+		if keys.IdentityKey != nil {
+			identity = keys.IdentityKey
+		}
+		if keys.LinkKey != nil {
+			if err = writeLinkKey(cfg.Server.DataDir, keys.LinkKey); err != nil {
+				return err
+			}
+		}
+	}
 	cfg.Debug.IdentityKey = identity
 
 	if isVoting {
@@ -384,7 +1548,7 @@ func (k *Kimchi) genNodeConfig(isProvider bool, isVoting bool) error {
 	} else {
 		cfg.PKI = new(sConfig.PKI)
 		cfg.PKI.Nonvoting = new(sConfig.Nonvoting)
-		cfg.PKI.Nonvoting.Address = fmt.Sprintf("127.0.0.1:%d", k.authPort)
+		cfg.PKI.Nonvoting.Address = k.advertisedAddresses(k.authConfig.Authority.Addresses)[0]
 		if k.authIdentity == nil {
 		}
 		idKey, err := k.authIdentity.PublicKey().MarshalText()
@@ -397,74 +1561,105 @@ func (k *Kimchi) genNodeConfig(isProvider bool, isVoting bool) error {
 	if isProvider {
 		// Enable the thwack interface.
 		cfg.Management = new(sConfig.Management)
-		cfg.Management.Enable = true
-
-		k.providerIdx++
+		cfg.Management.Enable = !k.opts.DisableManagement[n]
+		cfg.Management.Path = filepath.Join(cfg.Server.DataDir, managementSocket)
 
 		cfg.Provider = new(sConfig.Provider)
+		if k.opts.SpoolBackend == sConfig.BackendSQL {
+			cfg.Provider.SQLDB = &sConfig.SQLDB{
+				Backend:        "pgx",
+				DataSourceName: k.opts.SQLDataSourceName,
+			}
+			cfg.Provider.SpoolDB = &sConfig.SpoolDB{Backend: sConfig.BackendSQL}
+		}
 
 		loopCfg := new(sConfig.Kaetzchen)
-		loopCfg.Capability = "loop"
-		loopCfg.Endpoint = "+loop"
+		loopCfg.Capability = k.opts.Services.Loop.Capability
+		loopCfg.Endpoint = k.opts.Services.Loop.Endpoint
 		cfg.Provider.Kaetzchen = append(cfg.Provider.Kaetzchen, loopCfg)
 
 		keysvrCfg := new(sConfig.Kaetzchen)
-		keysvrCfg.Capability = "keyserver"
-		keysvrCfg.Endpoint = "+keyserver"
+		keysvrCfg.Capability = k.opts.Services.Keyserver.Capability
+		keysvrCfg.Endpoint = k.opts.Services.Keyserver.Endpoint
 		cfg.Provider.Kaetzchen = append(cfg.Provider.Kaetzchen, keysvrCfg)
 
 		spoolCfg := new(sConfig.CBORPluginKaetzchen)
-		spoolCfg.Capability = "spool"
-		spoolCfg.Endpoint = "+spool"
-		spoolCfg.Command = path.Join(k.baseDir, "memspool")
+		spoolCfg.Capability = k.opts.Services.Spool.Capability
+		spoolCfg.Endpoint = k.opts.Services.Spool.Endpoint
+		spoolCfg.Command = k.memspoolCommand()
 		spoolCfg.Config = map[string]interface{}{
-			"log_dir":    path.Join(k.baseDir, n),
-			"data_store": path.Join(k.baseDir, n, "memspool.storage"),
+			"log_dir":    cfg.Server.DataDir,
+			"data_store": filepath.Join(cfg.Server.DataDir, "memspool.storage"),
 		}
 		spoolCfg.MaxConcurrency = 1
 		spoolCfg.Disable = false
 		cfg.Provider.CBORPluginKaetzchen = append(cfg.Provider.CBORPluginKaetzchen, spoolCfg)
-	} else {
-		k.nodeIdx++
 	}
-	k.nodeConfigs = append(k.nodeConfigs, cfg)
-	k.lastPort++
 	err = cfg.FixupAndValidate()
 	if err != nil {
 		return errors.New("genNodeConfig failure on fixupandvalidate")
 	}
+	if isProvider {
+		k.providerIdx++
+	} else {
+		k.nodeIdx++
+	}
+	k.nodeConfigs = append(k.nodeConfigs, cfg)
 	return nil
 }
 
-func (k *Kimchi) genAuthConfig() error {
-	const authLogFile = "authority.log"
+// nodeConfig returns the config of the node with the given identifier.
+func (k *Kimchi) nodeConfig(identifier string) (*sConfig.Config, error) {
+	for _, nodeCfg := range k.nodeConfigs {
+		if nodeCfg.Server.Identifier == identifier {
+			return nodeCfg, nil
+		}
+	}
+	return nil, fmt.Errorf("%v: %w", identifier, ErrNodeNotFound)
+}
 
-	// create nonvoting config.Parameters from generic parameters
-	parameters := &aConfig.Parameters{
-		SendRatePerMinute: k.parameters.SendRatePerMinute,
-		Mu:                k.parameters.Mu,
-		MuMaxDelay:        k.parameters.MuMaxDelay,
-		LambdaP:           k.parameters.LambdaP,
-		LambdaPMaxDelay:   k.parameters.LambdaPMaxDelay,
-		LambdaL:           k.parameters.LambdaL,
-		LambdaLMaxDelay:   k.parameters.LambdaLMaxDelay,
+// managedProvider returns the config of the provider with the given
+// identifier, which must have its management interface enabled.
+func (k *Kimchi) managedProvider(identifier string) (*sConfig.Config, error) {
+	cfg, err := k.nodeConfig(identifier)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Server.IsProvider {
+		return nil, fmt.Errorf("%v: %w", identifier, ErrNotAProvider)
 	}
+	if cfg.Management == nil || !cfg.Management.Enable {
+		return nil, fmt.Errorf("%v: %w", identifier, ErrManagementDisabled)
+	}
+	return cfg, nil
+}
+
+func (k *Kimchi) genAuthConfig() error {
+	parameters := k.nonvotingParameters()
 
+	addr, err := k.nextAddress(authorityPorts)
+	if err != nil {
+		return err
+	}
+	if _, err = k.frontAddress(authorityPorts, addr); err != nil {
+		return err
+	}
 	cfg := new(aConfig.Config)
 
 	// Authority section.
 	cfg.Authority = new(aConfig.Authority)
-	cfg.Authority.Addresses = []string{fmt.Sprintf("127.0.0.1:%d", k.lastPort)}
-	k.lastPort++
-	cfg.Authority.DataDir = filepath.Join(k.baseDir, "authority")
+	cfg.Authority.Addresses = []string{addr}
+	if cfg.Authority.DataDir, err = k.componentDataDir("authorities", "authority"); err != nil {
+		return err
+	}
 
 	// Parameters section.
 	cfg.Parameters = parameters
 
 	// Logging section.
 	cfg.Logging = new(aConfig.Logging)
-	cfg.Logging.File = authLogFile
-	cfg.Logging.Level = "DEBUG"
+	cfg.Logging.File = logFileName(k.opts.LogFiles.Authority, "authority.log")
+	cfg.Logging.Level = k.logLevel()
 
 	// Mkdir
 	if err := os.Mkdir(cfg.Authority.DataDir, 0700); err != nil {
@@ -481,6 +1676,8 @@ func (k *Kimchi) genAuthConfig() error {
 	// Debug section.
 	cfg.Debug = new(aConfig.Debug)
 	cfg.Debug.IdentityKey = idKey
+	cfg.Debug.Layers = k.layers()
+	cfg.Debug.MinNodesPerLayer = 1
 
 	if err := cfg.FixupAndValidate(); err != nil {
 		return err
@@ -507,7 +1704,15 @@ func (k *Kimchi) generateWhitelist() ([]*aConfig.Node, []*aConfig.Node, error) {
 		mixes = append(mixes, mix)
 	}
 
-	return providers, mixes, nil
+	extProviders, extMixes := k.externalNodes()
+	for _, n := range extProviders {
+		providers = append(providers, &aConfig.Node{Identifier: n.Identifier, IdentityKey: n.IdentityKey})
+	}
+	for _, n := range extMixes {
+		mixes = append(mixes, &aConfig.Node{IdentityKey: n.IdentityKey})
+	}
+
+	return providers, mixes, nil
 
 }
 
@@ -530,69 +1735,514 @@ func (k *Kimchi) generateVotingWhitelist() ([]*vConfig.Node, []*vConfig.Node, er
 		mixes = append(mixes, mix)
 	}
 
+	extProviders, extMixes := k.externalNodes()
+	for _, n := range extProviders {
+		providers = append(providers, &vConfig.Node{Identifier: n.Identifier, IdentityKey: n.IdentityKey})
+	}
+	for _, n := range extMixes {
+		mixes = append(mixes, &vConfig.Node{IdentityKey: n.IdentityKey})
+	}
+
+	return providers, mixes, nil
+}
+
+// Whitelist returns the identifiers of the providers and mixes currently in
+// the authorities' whitelists.
+func (k *Kimchi) Whitelist() (providers, mixes []string, err error) {
+	k.Lock()
+	defer k.Unlock()
+	return k.whitelist()
+}
+
+// whitelist is Whitelist for callers that already hold the lock.
+func (k *Kimchi) whitelist() (providers, mixes []string, err error) {
+	var pKeys, mKeys []*eddsa.PublicKey
+	if k.voting {
+		if len(k.votingAuthConfigs) == 0 {
+			return nil, nil, errors.New("no authorities configured")
+		}
+		aCfg := k.votingAuthConfigs[0]
+		for _, n := range aCfg.Providers {
+			pKeys = append(pKeys, n.IdentityKey)
+		}
+		for _, n := range aCfg.Mixes {
+			mKeys = append(mKeys, n.IdentityKey)
+		}
+	} else {
+		for _, n := range k.authConfig.Providers {
+			pKeys = append(pKeys, n.IdentityKey)
+		}
+		for _, n := range k.authConfig.Mixes {
+			mKeys = append(mKeys, n.IdentityKey)
+		}
+	}
+
+	ids := make(map[[eddsa.PublicKeySize]byte]string)
+	for _, nodeCfg := range k.nodeConfigs {
+		ids[nodeCfg.Debug.IdentityKey.PublicKey().ByteArray()] = nodeCfg.Server.Identifier
+	}
+	extProviders, extMixes := k.externalNodes()
+	for _, n := range append(extProviders, extMixes...) {
+		id := n.Identifier
+		if id == "" {
+			id = fmt.Sprintf("external-%v", n.IdentityKey)
+		}
+		ids[n.IdentityKey.ByteArray()] = id
+	}
+	lookup := func(keys []*eddsa.PublicKey) ([]string, error) {
+		r := make([]string, 0, len(keys))
+		for _, key := range keys {
+			id, ok := ids[key.ByteArray()]
+			if !ok {
+				return nil, fmt.Errorf("whitelisted key %v: %w", key, ErrNodeNotFound)
+			}
+			r = append(r, id)
+		}
+		return r, nil
+	}
+	if providers, err = lookup(pKeys); err != nil {
+		return nil, nil, err
+	}
+	if mixes, err = lookup(mKeys); err != nil {
+		return nil, nil, err
+	}
 	return providers, mixes, nil
 }
 
 func (k *Kimchi) runNonvoting() error {
 	a := k.authConfig
 	a.FixupAndValidate()
-	server, err := aServer.New(a)
+	server, err := k.newAuthority("nonvoting", func() (server, error) {
+		return k.newNonvotingAuthority(a)
+	})
 	if err != nil {
+		return fmt.Errorf("failed to launch nonvoting authority: %w", err)
+	}
+	if err = k.addServer("nonvoting", server); err != nil {
 		return err
 	}
-	go k.LogTailer("nonvoting", filepath.Join(a.Authority.DataDir, a.Logging.File))
-	k.servers = append(k.servers, server)
+	k.startLogTailer("nonvoting", filepath.Join(a.Authority.DataDir, a.Logging.File))
 	return nil
 }
 
+// newAuthority launches an authority with newFn, under a supervisor if
+// Options.AuthorityRestarts is set.
+func (k *Kimchi) newAuthority(identifier string, newFn func() (server, error)) (server, error) {
+	if k.opts.AuthorityRestarts > 0 {
+		s, err := supervise(identifier, k.opts.AuthorityRestarts, newFn)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return newFn()
+}
+
 func (k *Kimchi) runVotingAuthorities() error {
 	for _, vCfg := range k.votingAuthConfigs {
 		vCfg.FixupAndValidate()
-		server, err := vServer.New(vCfg)
+		cfg := vCfg
+		server, err := k.newAuthority(vCfg.Authority.Identifier, func() (server, error) {
+			return k.newVotingAuthority(cfg)
+		})
 		if err != nil {
+			return fmt.Errorf("failed to launch authority %v: %w", vCfg.Authority.Identifier, err)
+		}
+		if err = k.addServer(vCfg.Authority.Identifier, server); err != nil {
 			return err
 		}
-		go k.LogTailer(vCfg.Authority.Identifier, filepath.Join(vCfg.Authority.DataDir, vCfg.Logging.File))
-		k.servers = append(k.servers, server)
+		k.startLogTailer(vCfg.Authority.Identifier, filepath.Join(vCfg.Authority.DataDir, vCfg.Logging.File))
 	}
 	return nil
 }
 
-func (k *Kimchi) thwackUser(provider *sConfig.Config, user string, pubKey *ecdh.PublicKey) error {
-	log.Printf("Attempting to add user: %v@%v", user, provider.Server.Identifier)
+// StartupTimings returns, for each launched node and authority, the time
+// from the start of Run until it was up.  As every entry is measured from
+// the same starting point, the largest one is the aggregate startup time.
+func (k *Kimchi) StartupTimings() map[string]time.Duration {
+	k.Lock()
+	defer k.Unlock()
+	return copyTimings(k.startupTimings)
+}
+
+// ReadyTimings returns, for each node that has appeared in a consensus,
+// the time from the start of Run until the consensus including it was
+// first observed.  Nodes are only observed while something polls the
+// consensus, such as RunContext, WaitForReady or the readiness watcher
+// that Run starts, so the times are accurate to the consensus poll
+// interval.
+func (k *Kimchi) ReadyTimings() map[string]time.Duration {
+	k.Lock()
+	defer k.Unlock()
+	return copyTimings(k.readyTimings)
+}
 
-	sockFn := filepath.Join(provider.Server.DataDir, "management_sock")
-	c, err := textproto.Dial("unix", sockFn)
+func copyTimings(timings map[string]time.Duration) map[string]time.Duration {
+	t := make(map[string]time.Duration, len(timings))
+	for id, d := range timings {
+		t[id] = d
+	}
+	return t
+}
+
+// WritePortMap writes ports.txt to the base directory, listing the
+// identifier, class and address of every listener, one per line.
+func (k *Kimchi) WritePortMap() error {
+	var b bytes.Buffer
+	add := func(identifier, class string, addrs []string) {
+		for _, addr := range addrs {
+			fmt.Fprintf(&b, "%v %v %v\n", identifier, class, addr)
+		}
+		for _, addr := range k.advertisedAddresses(addrs) {
+			if !containsString(addrs, addr) {
+				fmt.Fprintf(&b, "%v %v-advertised %v\n", identifier, class, addr)
+			}
+		}
+	}
+	if k.voting {
+		for _, aCfg := range k.votingAuthConfigs {
+			add(aCfg.Authority.Identifier, "authority", aCfg.Authority.Addresses)
+		}
+	} else {
+		add("nonvoting", "authority", k.authConfig.Authority.Addresses)
+	}
+	for _, nodeCfg := range k.nodeConfigs {
+		if !nodeCfg.Server.IsProvider {
+			add(nodeCfg.Server.Identifier, "mix", nodeCfg.Server.Addresses)
+			continue
+		}
+		add(nodeCfg.Server.Identifier, "provider", nodeCfg.Server.Addresses)
+		if nodeCfg.Management != nil && nodeCfg.Management.Enable {
+			fmt.Fprintf(&b, "%v management %v\n", nodeCfg.Server.Identifier, nodeCfg.Management.Path)
+		}
+	}
+	k.Lock()
+	if k.socksBridge != nil {
+		fmt.Fprintf(&b, "socks-bridge socks5 %v\n", k.socksBridge.l.Addr())
+	}
+	k.Unlock()
+	return ioutil.WriteFile(filepath.Join(k.baseDir, "ports.txt"), b.Bytes(), 0600)
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ManagementSocket returns the path of the named provider's management
+// socket.
+func (k *Kimchi) ManagementSocket(provider string) (string, error) {
+	cfg, err := k.managedProvider(provider)
+	if err != nil {
+		return "", err
+	}
+	return cfg.Management.Path, nil
+}
+
+// AddUser registers user, with the given public key, on the named provider.
+// The key is used as both the user's link key and identity key.
+func (k *Kimchi) AddUser(provider, user string, pubKey *ecdh.PublicKey) error {
+	return k.AddUserWithIdentity(provider, user, pubKey, pubKey)
+}
+
+// AddUserWithIdentity registers user on the named provider with distinct
+// link and identity keys.  The link key authenticates the user's
+// connections to the provider, and the identity key is the one the
+// provider's keyserver hands out.
+func (k *Kimchi) AddUserWithIdentity(provider, user string, linkKey, identityKey *ecdh.PublicKey) error {
+	cfg, err := k.managedProvider(provider)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	return k.thwackUser(cfg, user, linkKey, identityKey)
+}
 
-	if _, _, err = c.ReadResponse(int(thwack.StatusServiceReady)); err != nil {
+// AddUserContext registers user like AddUser, retrying until it succeeds
+// or the context is done.  Failures to connect to the management interface
+// or to read its responses are retried; a command the provider rejects,
+// such as adding a user that already exists, is returned immediately as a
+// *ManagementError.
+func (k *Kimchi) AddUserContext(ctx context.Context, provider, user string, pubKey *ecdh.PublicKey) error {
+	cfg, err := k.managedProvider(provider)
+	if err != nil {
 		return err
 	}
 
-	for _, v := range []string{
-		fmt.Sprintf("ADD_USER %v %v", user, pubKey),
-		fmt.Sprintf("SET_USER_IDENTITY %v %v", user, pubKey),
-		"QUIT",
-	} {
-		if err = c.PrintfLine("%v", v); err != nil {
+	// Once ADD_USER has succeeded, a retry must not add the user again.
+	verb := "ADD_USER"
+	backoff := 50 * time.Millisecond
+	for {
+		var resps []ManagementResponse
+		resps, err = k.managementCommands(ctx, cfg, userCommands(verb, user, pubKey, pubKey)...)
+		var mErr *ManagementError
+		if err == nil || errors.As(err, &mErr) {
 			return err
 		}
-		if _, _, err = c.ReadResponse(int(thwack.StatusOk)); err != nil {
-			return err
+		if len(resps) > 0 {
+			verb = "UPDATE_USER"
+		}
+		log.Printf("Failed to add user %v@%v, retrying: %v", user, provider, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
 		}
 	}
+}
 
+// UserExists returns true iff the named provider has an account for user.
+func (k *Kimchi) UserExists(provider, user string) (bool, error) {
+	cfg, err := k.managedProvider(provider)
+	if err != nil {
+		return false, err
+	}
+	return k.userExists(cfg, user)
+}
+
+func (k *Kimchi) userExists(provider *sConfig.Config, user string) (bool, error) {
+	_, err := k.managementCommands(context.Background(), provider, "USER_LINK "+user)
+	var mErr *ManagementError
+	if errors.As(err, &mErr) && mErr.Response.Code == int(thwack.StatusTransactionFailed) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UserIdentity returns the identity key the named provider has for user.
+func (k *Kimchi) UserIdentity(provider, user string) (*ecdh.PublicKey, error) {
+	cfg, err := k.managedProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	resps, err := k.managementCommands(context.Background(), cfg, "USER_IDENTITY "+user)
+	if err != nil {
+		return nil, err
+	}
+	pubKey := new(ecdh.PublicKey)
+	if err = pubKey.FromString(resps[0].Message); err != nil {
+		return nil, fmt.Errorf("invalid identity key for %v: %w", user, err)
+	}
+	return pubKey, nil
+}
+
+func (k *Kimchi) thwackUser(provider *sConfig.Config, user string, linkKey, identityKey *ecdh.PublicKey) error {
+	log.Printf("Attempting to add user: %v@%v", user, provider.Server.Identifier)
+
+	_, err := k.managementCommands(context.Background(), provider, userCommands("ADD_USER", user, linkKey, identityKey)...)
+	return err
+}
+
+// userCommands returns the management commands that add (or update, with
+// the UPDATE_USER verb) user with the given link key and identity key.
+func userCommands(verb, user string, linkKey, identityKey *ecdh.PublicKey) []string {
+	return []string{
+		fmt.Sprintf("%v %v %v", verb, user, linkKey),
+		fmt.Sprintf("SET_USER_IDENTITY %v %v", user, identityKey),
+		"QUIT",
+	}
+}
+
+// ManagementResponse is a response to a provider management command.
+type ManagementResponse struct {
+	// Code is the thwack status code.
+	Code int
+
+	// Message is the rest of the response line, the reason for most
+	// commands or the value for queries such as USER_IDENTITY.
+	Message string
+}
+
+// ManagementError is the error returned when a management command does
+// not succeed.
+type ManagementError struct {
+	// Command is the verb of the failed command (Eg: "ADD_USER").
+	Command string
+
+	// Response is the provider's response.
+	Response ManagementResponse
+}
+
+func (e *ManagementError) Error() string {
+	return fmt.Sprintf("%v failed: %v %v", e.Command, e.Response.Code, e.Response.Message)
+}
+
+// ManagementCommand sends a single command to the named provider's
+// management interface and returns the response, whatever its status code.
+// An error is only returned if the command could not be sent or the
+// response read.
+func (k *Kimchi) ManagementCommand(provider, command string) (*ManagementResponse, error) {
+	cfg, err := k.managedProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	resps, err := k.managementCommands(context.Background(), cfg, command)
+	var mErr *ManagementError
+	if errors.As(err, &mErr) {
+		return &mErr.Response, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &resps[0], nil
+}
+
+// managementCommands sends the commands to the provider's management
+// interface in turn and returns their responses.  It stops at the first
+// command that does not succeed, and returns a *ManagementError for it.
+func (k *Kimchi) managementCommands(ctx context.Context, provider *sConfig.Config, cmds ...string) ([]ManagementResponse, error) {
+	c, err := k.dialManagement(ctx, provider)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	resps := make([]ManagementResponse, 0, len(cmds))
+	for _, cmd := range cmds {
+		if err = c.PrintfLine("%v", cmd); err != nil {
+			return resps, err
+		}
+		code, msg, err := c.ReadResponse(0)
+		if err != nil {
+			return resps, err
+		}
+		resp := ManagementResponse{Code: code, Message: msg}
+		resps = append(resps, resp)
+		if code != int(thwack.StatusOk) {
+			verb := cmd
+			if i := strings.IndexByte(cmd, ' '); i >= 0 {
+				verb = cmd[:i]
+			}
+			return resps, &ManagementError{Command: verb, Response: resp}
+		}
+	}
+	return resps, nil
+}
+
+// dialManagement connects to the provider's management socket and reads
+// the ready banner, retrying with backoff for up to
+// Options.ManagementDialTimeout while the provider starts up, or until the
+// context is done.
+func (k *Kimchi) dialManagement(ctx context.Context, provider *sConfig.Config) (*textproto.Conn, error) {
+	timeout := k.opts.ManagementDialTimeout
+	if timeout == 0 {
+		timeout = defaultManagementDialTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := 50 * time.Millisecond
+	for {
+		c, err := textproto.Dial("unix", provider.Management.Path)
+		if err == nil {
+			if _, _, err = c.ReadResponse(int(thwack.StatusServiceReady)); err == nil {
+				return c, nil
+			}
+			c.Close()
+		}
+		if timeout < 0 || time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
+
+// AddRecipient registers the public key for a recipient address, so that
+// keys for external clients can be loaded before any are handed out.
+func (k *Kimchi) AddRecipient(addr string, key *ecdh.PublicKey) {
+	k.Lock()
+	defer k.Unlock()
+	k.recipients[addr] = key
+}
+
+// Recipients returns a copy of the known recipient public keys.
+func (k *Kimchi) Recipients() map[string]*ecdh.PublicKey {
+	k.Lock()
+	defer k.Unlock()
+	r := make(map[string]*ecdh.PublicKey, len(k.recipients))
+	for addr, key := range k.recipients {
+		r[addr] = key
+	}
+	return r
+}
+
+// recipientBundle is the format of ExportRecipients and ImportRecipients.
+type recipientBundle struct {
+	Recipients map[string]*ecdh.PublicKey
+}
+
+// ExportRecipients writes the known recipient public keys to w as JSON,
+// sorted by address, in the form read by ImportRecipients.
+func (k *Kimchi) ExportRecipients(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&recipientBundle{Recipients: k.Recipients()})
+}
+
+// ImportRecipients reads recipient public keys written by ExportRecipients
+// from r and adds them, replacing the keys of any addresses already known.
+func (k *Kimchi) ImportRecipients(r io.Reader) error {
+	var b recipientBundle
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return fmt.Errorf("invalid recipient bundle: %w", err)
+	}
+	for addr, key := range b.Recipients {
+		if key == nil {
+			return fmt.Errorf("invalid recipient bundle: no key for '%v'", addr)
+		}
+	}
+	for addr, key := range b.Recipients {
+		k.AddRecipient(addr, key)
+	}
 	return nil
 }
 
+// startLogTailer registers a log tailer with the WaitGroup before spawning
+// it, so that a Shutdown racing with the spawn still waits for it.
+func (k *Kimchi) startLogTailer(prefix, path string) {
+	if k.opts.Quiet && !k.opts.NodeOutputFiles {
+		return
+	}
+	k.Add(1)
+	go func() {
+		defer k.Done()
+		k.tailLog(prefix, path)
+	}()
+}
+
 func (k *Kimchi) LogTailer(prefix, path string) {
 	k.Add(1)
 	defer k.Done()
+	k.tailLog(prefix, path)
+}
 
-	l := log.New(k.logWriter, prefix+" ", 0)
+func (k *Kimchi) tailLog(prefix, path string) {
+	var l, out *log.Logger
+	if !k.opts.Quiet {
+		l = log.New(k.logWriter, prefix+" ", 0)
+	}
+	if k.opts.NodeOutputFiles {
+		outPath := filepath.Join(k.baseDir, prefix+".out")
+		f, err := os.OpenFile(outPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create output file '%v': %v", outPath, err)
+		}
+		defer f.Close()
+		out = log.New(f, prefix+" ", 0)
+	}
 	t, err := tail.TailFile(path, tailConfig)
 	defer t.Cleanup()
 	if err != nil {
@@ -601,45 +2251,285 @@ func (k *Kimchi) LogTailer(prefix, path string) {
 
 	k.Lock()
 	k.tails = append(k.tails, t)
+	haltCh := k.haltCh
 	k.Unlock()
 
+	// Shutdown may have already stopped the tails it knew about.
+	select {
+	case <-haltCh:
+		t.StopAtEOF()
+	default:
+	}
+
 	for line := range t.Lines {
-		l.Print(line.Text)
+		if out != nil {
+			out.Print(line.Text)
+		}
+		if l != nil && !k.loggingPaused() && (k.opts.LogFilter == nil || k.opts.LogFilter(prefix, line.Text)) {
+			l.Print(line.Text)
+		}
 	}
 }
 
+// PauseLogging stops the tailed component log lines from being written to
+// the aggregate log until ResumeLogging is called.  The lines tailed in the
+// meantime are dropped from the aggregate log, but are still in each
+// component's own log and NodeOutputFiles.
+func (k *Kimchi) PauseLogging() {
+	k.Lock()
+	defer k.Unlock()
+	k.logPaused = true
+}
+
+// ResumeLogging resumes writing tailed component log lines to the
+// aggregate log after PauseLogging.
+func (k *Kimchi) ResumeLogging() {
+	k.Lock()
+	defer k.Unlock()
+	k.logPaused = false
+}
+
+func (k *Kimchi) loggingPaused() bool {
+	k.Lock()
+	defer k.Unlock()
+	return k.logPaused
+}
+
+// logPath returns the path of the log file of the node or authority with
+// the given identifier.
+func (k *Kimchi) logPath(identifier string) (string, error) {
+	if cfg, err := k.nodeConfig(identifier); err == nil {
+		return filepath.Join(cfg.Server.DataDir, cfg.Logging.File), nil
+	}
+	if k.voting {
+		for _, aCfg := range k.votingAuthConfigs {
+			if aCfg.Authority.Identifier == identifier {
+				return filepath.Join(aCfg.Authority.DataDir, aCfg.Logging.File), nil
+			}
+		}
+	} else if identifier == "nonvoting" {
+		return filepath.Join(k.authConfig.Authority.DataDir, k.authConfig.Logging.File), nil
+	}
+	return "", fmt.Errorf("%v: %w", identifier, ErrNodeNotFound)
+}
+
+// TailNode streams the lines of the log of the node or authority with the
+// given identifier, independently of the aggregate log.  The returned
+// function stops the tail and closes the channel.
+func (k *Kimchi) TailNode(identifier string) (<-chan string, func(), error) {
+	path, err := k.logPath(identifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := tail.TailFile(path, tailConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan string)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for line := range t.Lines {
+			select {
+			case ch <- line.Text:
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(doneCh)
+			t.Stop()
+			t.Cleanup()
+		})
+	}
+	return ch, stop, nil
+}
+
 func (k *Kimchi) Shutdown() {
-	for _, svr := range k.servers {
+	k.halt()
+	if k.tempBaseDir && !k.opts.PreserveData {
+		if err := os.RemoveAll(k.baseDir); err != nil {
+			log.Printf("Failed to remove base directory: %v", err)
+		}
+	}
+	log.Printf("Terminated.")
+}
+
+// HandleSignals makes the first SIGINT or SIGTERM call Shutdown.  The
+// returned function uninstalls the handler.
+func (k *Kimchi) HandleSignals() (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	doneCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ch:
+			log.Printf("Received shutdown request.")
+			k.Shutdown()
+		case <-doneCh:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(doneCh)
+		})
+	}
+}
+
+// halt shuts down every running server, stops the log tailers and waits
+// for them to return.
+func (k *Kimchi) halt() {
+	k.Lock()
+	k.running = false
+	k.closeHaltCh()
+	servers := k.servers
+	k.servers = nil
+	k.serverByID = nil
+	prevGOMAXPROCS := k.prevGOMAXPROCS
+	k.prevGOMAXPROCS = 0
+	k.Unlock()
+
+	k.stopSOCKSBridge()
+	k.stopFaultProxies()
+	for _, svr := range servers {
 		svr.Shutdown()
 	}
-	for _, t := range k.tails {
+
+	k.Lock()
+	tails := k.tails
+	k.tails = nil
+	k.Unlock()
+	for _, t := range tails {
 		t.StopAtEOF()
 	}
-	k.Wait()
-	log.Printf("Terminated.")
+	k.WaitGroup.Wait()
+	if prevGOMAXPROCS > 0 {
+		runtime.GOMAXPROCS(prevGOMAXPROCS)
+	}
+}
+
+// closeHaltCh closes haltCh, if it is not already closed, which makes
+// servers launched from then on be shut down.  The caller must hold the
+// lock.
+func (k *Kimchi) closeHaltCh() {
+	if k.haltCh != nil {
+		select {
+		case <-k.haltCh:
+		default:
+			close(k.haltCh)
+		}
+	}
+}
+
+// Wait blocks until every launched server has exited, whether because of
+// Shutdown or on its own, then stops the rest of the network and waits for
+// the log tailers to return.
+func (k *Kimchi) Wait() {
+	k.Lock()
+	servers := append([]server{}, k.servers...)
+	k.Unlock()
+	for _, svr := range servers {
+		svr.Wait()
+	}
+	k.halt()
+}
+
+// Reset shuts down the network, removes the component data directories and
+// regenerates the configs for the given topology in the same base
+// directory.  Options other than the topology are kept, except for Tags.
+func (k *Kimchi) Reset(voting bool, nVoting, nProvider, nMix int) error {
+	k.halt()
+
+	dirs := make([]string, 0, len(k.nodeConfigs)+len(k.votingAuthConfigs)+1)
+	if k.authConfig != nil {
+		dirs = append(dirs, k.authConfig.Authority.DataDir)
+	}
+	for _, aCfg := range k.votingAuthConfigs {
+		dirs = append(dirs, aCfg.Authority.DataDir)
+	}
+	for _, nodeCfg := range k.nodeConfigs {
+		dirs = append(dirs, nodeCfg.Server.DataDir)
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	ports, err := newPortRanges(k.opts.BasePort, k.opts.PortRanges)
+	if err != nil {
+		return fmt.Errorf("invalid port ranges: %w", err)
+	}
+
+	k.Lock()
+	k.voting = voting
+	k.nVoting = nVoting
+	k.nProvider = nProvider
+	k.nMix = nMix
+	k.opts.Voting = voting
+	k.opts.NVoting = nVoting
+	k.opts.NProvider = nProvider
+	k.opts.NMix = nMix
+	k.opts.Tags = nil
+	k.authConfig = nil
+	k.votingAuthConfigs = nil
+	k.authIdentity = nil
+	k.nodeConfigs = make([]*sConfig.Config, 0)
+	k.ports = ports
+	k.frontAddrs = make(map[string]string)
+	k.faultProxies = nil
+	k.nodeIdx = 0
+	k.providerIdx = 0
+	k.recipients = make(map[string]*ecdh.PublicKey)
+	k.tags = nil
+	k.startupTimings = nil
+	k.readyTimings = nil
+	k.ready = false
+	k.readyFns = nil
+	k.lastMissing = nil
+	k.launchedConfigs = nil
+	k.Unlock()
+
+	if err = k.initConfig(); err != nil {
+		return fmt.Errorf("failed to initConfig(): %w", err)
+	}
+	return nil
 }
 
 func (k *Kimchi) runWithDelayedAuthority(delay time.Duration) {
+	k.runStart = time.Now()
+	k.startupTimings = make(map[string]time.Duration)
+	k.readyTimings = make(map[string]time.Duration)
+
 	// Launch all the nodes.
 	for _, v := range k.nodeConfigs {
 		v.FixupAndValidate()
-		svr, err := nServer.New(v)
+		svr, err := k.launchNode(v)
 		if err != nil {
 			log.Fatalf("Failed to launch node: %v", err)
 		}
-
-		k.servers = append(k.servers, svr)
-		go k.LogTailer(v.Server.Identifier, filepath.Join(v.Server.DataDir, v.Logging.File))
+		k.addServer(v.Server.Identifier, svr)
+		k.startLogTailer(v.Server.Identifier, filepath.Join(v.Server.DataDir, v.Logging.File))
 	}
 
 	f := func(vCfg *vConfig.Config) {
 		vCfg.FixupAndValidate()
-		server, err := vServer.New(vCfg)
+		server, err := k.newVotingAuthority(vCfg)
 		if err != nil {
 			return
 		}
-		go k.LogTailer(vCfg.Authority.Identifier, filepath.Join(vCfg.Authority.DataDir, vCfg.Logging.File))
-		k.servers = append(k.servers, server)
+		if err = k.addServer(vCfg.Authority.Identifier, server); err != nil {
+			return
+		}
+		k.startLogTailer(vCfg.Authority.Identifier, filepath.Join(vCfg.Authority.DataDir, vCfg.Logging.File))
 	}
 
 	for _, vCfg := range k.votingAuthConfigs[:len(k.votingAuthConfigs)-1] {
@@ -652,65 +2542,206 @@ func (k *Kimchi) runWithDelayedAuthority(delay time.Duration) {
 	}()
 }
 
+// ClientOptions are the optional settings for a generated client config.
+// Zero values keep the defaults.
+type ClientOptions struct {
+	// UpstreamProxy, if set, routes the client's connections through the
+	// given proxy (Eg: a local Tor SOCKS5 port).  Connections are direct
+	// when it is unset.
+	UpstreamProxy *cConfig.UpstreamProxy
+
+	// SessionDialTimeout is the number of seconds a session dial may take.
+	SessionDialTimeout int
+
+	// InitialMaxPKIRetrievalDelay is the number of seconds the client
+	// initially waits for a PKI document.
+	InitialMaxPKIRetrievalDelay int
+
+	// PollingInterval is the number of seconds between polls of the
+	// receive queue.  It defaults to 10.
+	PollingInterval int
+
+	// UseSOCKSBridge routes the client's connections through the bridge
+	// started by StartSOCKSBridge.  It overrides UpstreamProxy.
+	UseSOCKSBridge bool
+
+	// EnableDecoyLoops makes the client send loop and drop decoy traffic.
+	// The rates are set by the LambdaL and LambdaD mix network
+	// Parameters.  Decoy loops are disabled by default.
+	EnableDecoyLoops bool
+
+	// ExistingUser, if set, is an account that already exists on the
+	// provider, with the link key ExistingLinkKey.  It is used instead of
+	// registering a new account, and its key is added to the recipients.
+	ExistingUser    string
+	ExistingLinkKey *ecdh.PrivateKey
+
+	// Provider is the identifier of the provider ExistingUser is on.  It
+	// defaults to the first provider.
+	Provider string
+
+	// CheckExistingUser makes the provider's management interface be
+	// asked whether ExistingUser exists, and fails if it does not.
+	CheckExistingUser bool
+}
+
 func (k *Kimchi) GetClientConfig() (*cConfig.Config, string, *ecdh.PrivateKey, error) {
-	cfg := new(cConfig.Config)
-	m := rand.NewMath()
-	cfg.Logging = &cConfig.Logging{
-		Disable: false,
-		File:    "katzenpost.log",
-		Level:   "DEBUG",
-	}
-	cfg.UpstreamProxy = &cConfig.UpstreamProxy{Type: "none"}
-	cfg.Debug = &cConfig.Debug{
-		DisableDecoyLoops: true,
-		PollingInterval:   10,
-	}
+	return k.GetClientConfigWithOptions(nil)
+}
 
-	// authority section
-	if k.voting {
-		p, err := sConfig.AuthorityPeersFromPeers(k.votingPeers())
-		if err != nil {
-			return nil, "", nil, err
-		}
-		cfg.VotingAuthority = &cConfig.VotingAuthority{
-			Peers: p,
-		}
-	} else {
-		cfg.NonvotingAuthority = &cConfig.NonvotingAuthority{
-			Address:   k.authConfig.Authority.Addresses[0],
-			PublicKey: k.authIdentity.PublicKey(),
-		}
+func (k *Kimchi) GetClientConfigWithOptions(opts *ClientOptions) (*cConfig.Config, string, *ecdh.PrivateKey, error) {
+	if opts != nil && opts.ExistingUser != "" {
+		return k.existingClientConfig(opts)
 	}
-
-	cfg.Account = &cConfig.Account{}
+	m := rand.NewMath()
 
 	// select a username for the user
 	usernames := []string{"alice", "bob", "mallory"}
 	username := fmt.Sprintf("%s%d", usernames[m.Intn(len(usernames))], m.Intn(255))
 
-	// find a provider
+	// find a provider that users can be added to
 	for _, nCfg := range k.nodeConfigs {
-		if nCfg.Server.IsProvider {
-			cfg.Account.Provider = nCfg.Server.Identifier
-			cfg.Account.ProviderKeyPin = nCfg.Debug.IdentityKey.PublicKey()
+		if nCfg.Server.IsProvider && nCfg.Management.Enable {
+			cfg, err := k.clientConfig(nCfg, opts)
+			if err != nil {
+				return nil, "", nil, err
+			}
 
 			// Generate keys for the account
 			linkKey, err := ecdh.NewKeypair(m)
 			if err != nil {
 				return nil, "", nil, err
 			}
-			if err := cfg.FixupAndValidate(); err != nil {
-				return nil, "", nil, err
-			}
 
 			// register the account on the provider
-			if err := k.thwackUser(nCfg, username, linkKey.PublicKey()); err != nil {
+			if err := k.thwackUser(nCfg, username, linkKey.PublicKey(), linkKey.PublicKey()); err != nil {
 				return nil, "", nil, err
 			}
 			return cfg, username, linkKey, nil
 		}
 	}
-	return nil, "", nil, errors.New("no providers found")
+	return nil, "", nil, errors.New("no providers with a management interface found")
+}
+
+func (k *Kimchi) existingClientConfig(opts *ClientOptions) (*cConfig.Config, string, *ecdh.PrivateKey, error) {
+	if opts.ExistingLinkKey == nil {
+		return nil, "", nil, errors.New("ExistingUser requires ExistingLinkKey")
+	}
+	nCfg, err := k.existingUserProvider(opts.Provider)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if opts.CheckExistingUser {
+		ok, err := k.UserExists(nCfg.Server.Identifier, opts.ExistingUser)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if !ok {
+			return nil, "", nil, fmt.Errorf("user %v@%v does not exist", opts.ExistingUser, nCfg.Server.Identifier)
+		}
+	}
+	cfg, err := k.clientConfig(nCfg, opts)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	k.AddRecipient(fmt.Sprintf("%v@%v", opts.ExistingUser, nCfg.Server.Identifier), opts.ExistingLinkKey.PublicKey())
+	return cfg, opts.ExistingUser, opts.ExistingLinkKey, nil
+}
+
+// existingUserProvider returns the config of the named provider, or of the
+// first provider if identifier is empty.
+func (k *Kimchi) existingUserProvider(identifier string) (*sConfig.Config, error) {
+	if identifier == "" {
+		for _, nCfg := range k.nodeConfigs {
+			if nCfg.Server.IsProvider {
+				return nCfg, nil
+			}
+		}
+		return nil, errors.New("no providers found")
+	}
+	nCfg, err := k.nodeConfig(identifier)
+	if err != nil {
+		return nil, err
+	}
+	if !nCfg.Server.IsProvider {
+		return nil, fmt.Errorf("%v: %w", identifier, ErrNotAProvider)
+	}
+	return nCfg, nil
+}
+
+// ClientConfig returns a client config for an account on the named
+// provider, without generating keys or registering a user, suitable for
+// serializing and handing to a client running elsewhere.  The client config
+// has no user name; the account must be added with AddUser.
+func (k *Kimchi) ClientConfig(provider string, opts *ClientOptions) (*cConfig.Config, error) {
+	nCfg, err := k.nodeConfig(provider)
+	if err != nil {
+		return nil, err
+	}
+	if !nCfg.Server.IsProvider {
+		return nil, fmt.Errorf("%v: %w", provider, ErrNotAProvider)
+	}
+	return k.clientConfig(nCfg, opts)
+}
+
+func (k *Kimchi) clientConfig(provider *sConfig.Config, opts *ClientOptions) (*cConfig.Config, error) {
+	if opts == nil {
+		opts = &ClientOptions{}
+	}
+	cfg := new(cConfig.Config)
+	cfg.Logging = &cConfig.Logging{
+		Disable: false,
+		File:    logFileName(k.opts.LogFiles.Client, "katzenpost.log"),
+		Level:   k.logLevel(),
+	}
+	cfg.UpstreamProxy = &cConfig.UpstreamProxy{Type: "none"}
+	if opts.UpstreamProxy != nil {
+		cfg.UpstreamProxy = opts.UpstreamProxy
+	}
+	if opts.UseSOCKSBridge {
+		k.Lock()
+		b := k.socksBridge
+		k.Unlock()
+		if b == nil {
+			return nil, errors.New("SOCKS5 bridge is not running")
+		}
+		cfg.UpstreamProxy = &cConfig.UpstreamProxy{
+			Type:    "socks5",
+			Network: "tcp",
+			Address: b.l.Addr().String(),
+		}
+	}
+	cfg.Debug = &cConfig.Debug{
+		DisableDecoyLoops:           !opts.EnableDecoyLoops,
+		PollingInterval:             10,
+		SessionDialTimeout:          opts.SessionDialTimeout,
+		InitialMaxPKIRetrievalDelay: opts.InitialMaxPKIRetrievalDelay,
+	}
+	if opts.PollingInterval != 0 {
+		cfg.Debug.PollingInterval = opts.PollingInterval
+	}
+
+	// authority section
+	if k.voting {
+		p, err := sConfig.AuthorityPeersFromPeers(k.votingPeers())
+		if err != nil {
+			return nil, err
+		}
+		cfg.VotingAuthority = &cConfig.VotingAuthority{
+			Peers: p,
+		}
+	} else {
+		cfg.NonvotingAuthority = k.NonvotingAuthority()
+	}
+
+	cfg.Account = &cConfig.Account{
+		Provider:       provider.Server.Identifier,
+		ProviderKeyPin: provider.Debug.IdentityKey.PublicKey(),
+	}
+	if err := cfg.FixupAndValidate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 func retry(p pki.Client, epoch uint64, retries int) (reply []byte, err error) {
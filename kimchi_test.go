@@ -0,0 +1,209 @@
+// kimchi_test.go - Katzenpost self contained test network tests.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	aConfig "github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	sConfig "github.com/katzenpost/server/config"
+)
+
+// fakeServer stands in for a node or authority without listening anywhere.
+type fakeServer struct {
+	once   sync.Once
+	haltCh chan struct{}
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{haltCh: make(chan struct{})}
+}
+
+func (s *fakeServer) Shutdown() {
+	s.once.Do(func() { close(s.haltCh) })
+}
+
+func (s *fakeServer) Wait() {
+	<-s.haltCh
+}
+
+func (s *fakeServer) isShutdown() bool {
+	select {
+	case <-s.haltCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// newTestKimchi generates a nonvoting network of one provider and, unless
+// opts.NMix is set, two mixes in a temporary directory, with every server
+// replaced by a fake.  The returned function shuts the network down and
+// removes the directory.
+func newTestKimchi(t *testing.T, opts Options) (*Kimchi, func()) {
+	dir, err := ioutil.TempDir("", "kimchi_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.BaseDir = dir
+	opts.BasePort = 40000
+	opts.Parameters = &Parameters{}
+	opts.NProvider = 1
+	if opts.NMix == 0 {
+		opts.NMix = 2
+	}
+	opts.Quiet = true
+	opts.MemspoolCommand = filepath.Join(dir, "memspool")
+	k, err := NewKimchiWithOptions(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	k.newNode = func(*sConfig.Config) (server, error) {
+		return newFakeServer(), nil
+	}
+	k.newNonvotingAuthority = func(*aConfig.Config) (server, error) {
+		return newFakeServer(), nil
+	}
+	return k, func() {
+		k.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLaunchFailureCleansUp(t *testing.T) {
+	k, cleanup := newTestKimchi(t, Options{})
+	defer cleanup()
+
+	// Fail the last node, after the others were launched.
+	var launched []*fakeServer
+	k.newNode = func(*sConfig.Config) (server, error) {
+		if len(launched) == 2 {
+			return nil, errors.New("injected launch failure")
+		}
+		s := newFakeServer()
+		launched = append(launched, s)
+		return s, nil
+	}
+	if err := k.Run(); err == nil {
+		t.Fatal("Run succeeded despite a failed node launch")
+	}
+	if len(launched) != 2 {
+		t.Fatalf("launched %d nodes before the failure, expected 2", len(launched))
+	}
+	for i, s := range launched {
+		if !s.isShutdown() {
+			t.Errorf("node %d was left running", i)
+		}
+	}
+	if err := k.AssertNoLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	k, cleanup := newTestKimchi(t, Options{})
+	defer cleanup()
+
+	if err := k.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Run(); err == nil || err.Error() != "already running" {
+		t.Fatalf("second Run returned %v, expected \"already running\"", err)
+	}
+	k.Shutdown()
+	if err := k.Run(); err != nil {
+		t.Fatalf("Run after Shutdown failed: %v", err)
+	}
+}
+
+func TestDisabledManagement(t *testing.T) {
+	k, cleanup := newTestKimchi(t, Options{
+		DisableManagement: map[string]bool{"provider-0": true},
+	})
+	defer cleanup()
+
+	key, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.AddUser("provider-0", "alice", key.PublicKey()); !errors.Is(err, ErrManagementDisabled) {
+		t.Errorf("AddUser returned %v, expected ErrManagementDisabled", err)
+	}
+	if _, err := k.ManagementSocket("provider-0"); !errors.Is(err, ErrManagementDisabled) {
+		t.Errorf("ManagementSocket returned %v, expected ErrManagementDisabled", err)
+	}
+}
+
+func TestRunContextWhileRunning(t *testing.T) {
+	k, cleanup := newTestKimchi(t, Options{})
+	defer cleanup()
+
+	var launched []*fakeServer
+	k.newNode = func(*sConfig.Config) (server, error) {
+		s := newFakeServer()
+		launched = append(launched, s)
+		return s, nil
+	}
+	if err := k.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := k.RunContext(ctx); err == nil || err.Error() != "already running" {
+		t.Fatalf("RunContext returned %v, expected \"already running\"", err)
+	}
+	for i, s := range launched {
+		if s.isShutdown() {
+			t.Errorf("node %d was shut down", i)
+		}
+	}
+}
+
+func TestLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kimchi_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, err = NewKimchiWithOptions(Options{
+		BaseDir:   dir,
+		BasePort:  40000,
+		NProvider: 1,
+		Quiet:     true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "at least one mix is required") {
+		t.Fatalf("generating a network without mixes returned %v", err)
+	}
+
+	for _, nMix := range []int{1, 2} {
+		k, cleanup := newTestKimchi(t, Options{NMix: nMix})
+		if layers := k.authConfig.Debug.Layers; layers != nMix {
+			t.Errorf("%d mixes got %d layers, expected %d", nMix, layers, nMix)
+		}
+		cleanup()
+	}
+}
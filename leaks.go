@@ -0,0 +1,87 @@
+// leaks.go - Katzenpost self contained test network leak checks.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	leakCheckTimeout = 5 * time.Second
+	leakCheckFrame   = "github.com/katzenpost/kimchi."
+)
+
+// AssertNoLeaks returns an error unless every goroutine tracked by the
+// kimchi has returned and no other goroutine is running kimchi code, such
+// as an unstopped TailNode or HandleSignals.  It is meant to be called
+// after Shutdown, and allows a few seconds for goroutines to wind down.
+func (k *Kimchi) AssertNoLeaks() error {
+	timeout := leakCheckTimeout
+	if k.opts.RaceMode {
+		timeout *= raceTimeoutFactor
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		k.WaitGroup.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(timeout):
+		return errors.New("background goroutines are still running")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		leaked := kimchiGoroutines()
+		if len(leaked) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// kimchiGoroutines returns the stacks of the goroutines, other than the
+// caller's, that are running kimchi code.
+func kimchiGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	// The first stack is always the calling goroutine's.
+	var leaked []string
+	for _, g := range strings.Split(string(buf), "\n\n")[1:] {
+		if strings.Contains(g, leakCheckFrame) {
+			leaked = append(leaked, g)
+		}
+	}
+	return leaked
+}
@@ -0,0 +1,87 @@
+// logbuffer.go - Katzenpost self contained test network in-memory log.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// logBuffer is an io.Writer that retains the last few lines written to it.
+type logBuffer struct {
+	sync.Mutex
+
+	lines   []string
+	next    int
+	full    bool
+	partial []byte
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{lines: make([]string, size)}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.partial = append(b.partial, p...)
+	for {
+		idx := bytes.IndexByte(b.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		b.lines[b.next] = string(b.partial[:idx])
+		b.next = (b.next + 1) % len(b.lines)
+		if b.next == 0 {
+			b.full = true
+		}
+		b.partial = b.partial[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (b *logBuffer) Lines() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.full {
+		return append([]string{}, b.lines[:b.next]...)
+	}
+	return append(append([]string{}, b.lines[b.next:]...), b.lines[:b.next]...)
+}
+
+// Logs returns the most recent lines of the aggregate log, oldest first.
+// It returns nil unless Options.LogBufferLines was set.
+func (k *Kimchi) Logs() []string {
+	if k.logBuffer == nil {
+		return nil
+	}
+	return k.logBuffer.Lines()
+}
+
+// LogContains returns true iff one of the buffered aggregate log lines
+// contains substr.
+func (k *Kimchi) LogContains(substr string) bool {
+	for _, l := range k.Logs() {
+		if strings.Contains(l, substr) {
+			return true
+		}
+	}
+	return false
+}
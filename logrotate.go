@@ -0,0 +1,136 @@
+// logrotate.go - Katzenpost self contained test network log rotation.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogRotation configures rotation of the aggregate log.  The current log
+// is renamed to kimchi.log.1, shifting the older ones up, once it reaches
+// MaxSize bytes or MaxAge, whichever is set and comes first.
+type LogRotation struct {
+	// MaxSize is the size in bytes at which the log is rotated.
+	MaxSize int64
+
+	// MaxAge is the age at which the log is rotated.
+	MaxAge time.Duration
+
+	// MaxFiles is the number of rotated logs kept.  It defaults to 5.
+	MaxFiles int
+}
+
+func (r *LogRotation) validate() error {
+	if r.MaxSize < 0 || r.MaxAge < 0 || r.MaxFiles < 0 {
+		return errors.New("invalid log rotation settings")
+	}
+	if r.MaxSize == 0 && r.MaxAge == 0 {
+		return errors.New("log rotation requires MaxSize or MaxAge")
+	}
+	return nil
+}
+
+// rotatingFile is an io.Writer appending to a log file that it rotates.
+type rotatingFile struct {
+	sync.Mutex
+
+	path   string
+	cfg    LogRotation
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, cfg LogRotation) (*rotatingFile, error) {
+	if cfg.MaxFiles == 0 {
+		cfg.MaxFiles = 5
+	}
+	r := &rotatingFile{path: path, cfg: cfg}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var rotateErr error
+	if r.needsRotation(int64(len(p))) {
+		rotateErr = r.rotate()
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (r *rotatingFile) needsRotation(n int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.cfg.MaxSize > 0 && r.size+n > r.cfg.MaxSize {
+		return true
+	}
+	return r.cfg.MaxAge > 0 && time.Since(r.opened) >= r.cfg.MaxAge
+}
+
+// rotate renames the log to kimchi.log.1, shifting the older ones up, and
+// opens a new log.  The old file is only closed once the new one is open,
+// so if anything fails the log carries on in the old file, and rotation is
+// retried once it has grown by another MaxSize or reached MaxAge again.
+func (r *rotatingFile) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.cfg.MaxFiles))
+	for i := r.cfg.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	old := r.f
+	err := os.Rename(r.path, r.path+".1")
+	if err == nil {
+		err = r.open()
+	}
+	if err != nil {
+		r.size = 0
+		r.opened = time.Now()
+		return fmt.Errorf("failed to rotate '%v': %w", r.path, err)
+	}
+	old.Close()
+	return nil
+}
@@ -0,0 +1,64 @@
+// logrotate_test.go - Katzenpost self contained test network log rotation tests.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kimchi_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kimchi.log")
+
+	// Every line is over half of MaxSize, so each write after the first
+	// rotates the log.
+	r, err := newRotatingFile(path, LogRotation{MaxSize: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	for i := 0; i < 5; i++ {
+		if _, err = fmt.Fprintf(r, "line %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, want := range map[string]string{
+		"":   "line 4\n",
+		".1": "line 3\n",
+		".2": "line 2\n",
+	} {
+		b, err := ioutil.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("kimchi.log%v is %q, expected %q", suffix, b, want)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than MaxFiles rotated logs were kept: %v", err)
+	}
+}
@@ -48,10 +48,24 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	p := &kimchi.Parameters{}
-	k := kimchi.NewKimchi(30000, "", p, *voting, *nVoting, *nProvider, *nMix)
+	k, err := kimchi.NewKimchiWithOptions(kimchi.Options{
+		BasePort:   30000,
+		Parameters: &kimchi.Parameters{},
+		Voting:     *voting,
+		NVoting:    *nVoting,
+		NProvider:  *nProvider,
+		NMix:       *nMix,
 
-	k.Run()
+		// Keep the component logs for inspection after shutdown.
+		PreserveData: true,
+	})
+	if err != nil {
+		log.Fatalf("Failed to generate network: %v", err)
+	}
+
+	if err := k.Run(); err != nil {
+		log.Fatalf("Failed to run network: %v", err)
+	}
 
 	/*
 	// Generate the private keys used by the clients in advance so they
@@ -0,0 +1,130 @@
+// reload.go - Katzenpost self contained test network config reloading.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+
+	sConfig "github.com/katzenpost/server/config"
+)
+
+// NodeConfigs returns the configs of every node.  They may be modified,
+// and the changes applied to running nodes with ReloadConfigs.
+func (k *Kimchi) NodeConfigs() []*sConfig.Config {
+	return append([]*sConfig.Config{}, k.nodeConfigs...)
+}
+
+// ReloadConfigs restarts every running node whose config changed since it
+// was launched.  The server can not reload its config, so each changed
+// node is restarted in turn; unchanged nodes are left alone.
+func (k *Kimchi) ReloadConfigs() error {
+	for _, cfg := range k.nodeConfigs {
+		id := cfg.Server.Identifier
+		k.Lock()
+		_, running := k.serverByID[id]
+		launched := k.launchedConfigs[id]
+		k.Unlock()
+		if !running || launched == dumpConfig(cfg) {
+			continue
+		}
+		if err := cfg.FixupAndValidate(); err != nil {
+			return fmt.Errorf("invalid config for %v: %w", id, err)
+		}
+		c := cfg
+		if err := k.replaceServer(id, func() (server, error) {
+			return k.launchNode(c)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// launchNode launches a node and records the config it was launched with.
+func (k *Kimchi) launchNode(cfg *sConfig.Config) (server, error) {
+	dump := dumpConfig(cfg)
+	svr, err := k.newNode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	k.Lock()
+	if k.launchedConfigs == nil {
+		k.launchedConfigs = make(map[string]string)
+	}
+	k.launchedConfigs[cfg.Server.Identifier] = dump
+	k.Unlock()
+	return svr, nil
+}
+
+// dumpConfig returns a deterministic text form of a config, following
+// pointers so that changes anywhere in it are detected.
+func dumpConfig(cfg *sConfig.Config) string {
+	var b bytes.Buffer
+	dumpValue(&b, reflect.ValueOf(cfg))
+	return b.String()
+}
+
+func dumpValue(b *bytes.Buffer, v reflect.Value) {
+	if v.CanInterface() {
+		if m, ok := v.Interface().(encoding.BinaryMarshaler); ok && !(v.Kind() == reflect.Ptr && v.IsNil()) {
+			raw, err := m.MarshalBinary()
+			fmt.Fprintf(b, "%x/%v", raw, err)
+			return
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("nil")
+			return
+		}
+		dumpValue(b, v.Elem())
+	case reflect.Struct:
+		b.WriteString("{")
+		for i := 0; i < v.NumField(); i++ {
+			fmt.Fprintf(b, "%s:", v.Type().Field(i).Name)
+			dumpValue(b, v.Field(i))
+			b.WriteString(",")
+		}
+		b.WriteString("}")
+	case reflect.Slice, reflect.Array:
+		b.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			dumpValue(b, v.Index(i))
+			b.WriteString(",")
+		}
+		b.WriteString("]")
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		b.WriteString("map[")
+		for _, key := range keys {
+			fmt.Fprintf(b, "%v:", key)
+			dumpValue(b, v.MapIndex(key))
+			b.WriteString(",")
+		}
+		b.WriteString("]")
+	default:
+		fmt.Fprintf(b, "%v", v)
+	}
+}
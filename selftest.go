@@ -0,0 +1,123 @@
+// selftest.go - Katzenpost self contained test network self test.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/client"
+	"github.com/katzenpost/client/session"
+)
+
+const selfTestPayload = "kimchi self test"
+
+// SelfTest registers a throwaway account, connects a client, and sends a
+// message to a provider's loop service, returning nil once the reply
+// comes back through the network.
+func (k *Kimchi) SelfTest(ctx context.Context) error {
+	return k.withSession(ctx, "selftest", func(s *session.Session) error {
+		desc, err := s.GetService(k.opts.Services.Loop.Capability)
+		if err != nil {
+			return err
+		}
+		reply, err := s.SendUnreliableMessage(desc.Name, desc.Provider, []byte(selfTestPayload))
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(reply, []byte(selfTestPayload)) {
+			return fmt.Errorf("unexpected loop reply from %v", desc.Provider)
+		}
+		return nil
+	})
+}
+
+// MeasureLatency connects a client and sends n messages, one at a time, to
+// a provider's loop service, returning the round trip time of each.  The
+// times include the mix delays drawn from the MixLambda and MixMaxDelay
+// parameters, as well as the client's wait for its send slot.
+func (k *Kimchi) MeasureLatency(ctx context.Context, n int) ([]time.Duration, error) {
+	if n < 1 {
+		return nil, errors.New("at least one message is required")
+	}
+	latencies := make([]time.Duration, 0, n)
+	err := k.withSession(ctx, "latency", func(s *session.Session) error {
+		desc, err := s.GetService(k.opts.Services.Loop.Capability)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			payload := []byte(fmt.Sprintf("kimchi latency %d", i))
+			start := time.Now()
+			reply, err := s.SendUnreliableMessage(desc.Name, desc.Provider, payload)
+			if err != nil {
+				return err
+			}
+			if !bytes.HasPrefix(reply, payload) {
+				return fmt.Errorf("unexpected loop reply from %v", desc.Provider)
+			}
+			latencies = append(latencies, time.Since(start))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return latencies, nil
+}
+
+// withSession registers a throwaway account, connects a client session for
+// it and runs fn with the session, giving up when the context is done.
+// The client logs to a file named after prefix and the account.
+func (k *Kimchi) withSession(ctx context.Context, prefix string, fn func(*session.Session) error) error {
+	cfg, user, linkKey, err := k.GetClientConfig()
+	if err != nil {
+		return err
+	}
+	cfg.Logging.File, err = k.dataDir("clients", fmt.Sprintf("%s-%s.log", prefix, user))
+	if err != nil {
+		return err
+	}
+	c, err := client.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Shutdown()
+
+	errCh := make(chan error, 1)
+	go func() {
+		s, err := c.NewSession(user, linkKey)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- fn(s)
+	}()
+
+	select {
+	case err = <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,138 @@
+// snapshot.go - Katzenpost self contained test network node snapshots.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SnapshotNode writes a tar archive of the named node's data directory,
+// including its keys and spool, to w.  The node must not be running, as
+// its databases could be captured mid-write; stop it with KillNode first.
+func (k *Kimchi) SnapshotNode(identifier string, w io.Writer) error {
+	cfg, err := k.nodeConfig(identifier)
+	if err != nil {
+		return err
+	}
+	if k.isRunning(identifier) {
+		return fmt.Errorf("%v is running", identifier)
+	}
+	dataDir := cfg.Server.DataDir
+
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(dataDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dataDir || !(fi.Mode().IsRegular() || fi.IsDir()) {
+			// Skip the root and anything like the management socket.
+			return nil
+		}
+		rel, err := filepath.Rel(dataDir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// RestoreNode replaces the named node's data directory with the contents
+// of a tar archive written by SnapshotNode.  The node must not be
+// running; stop it with KillNode first.
+func (k *Kimchi) RestoreNode(identifier string, r io.Reader) error {
+	cfg, err := k.nodeConfig(identifier)
+	if err != nil {
+		return err
+	}
+	if k.isRunning(identifier) {
+		return fmt.Errorf("%v is running", identifier)
+	}
+	dataDir := cfg.Server.DataDir
+	if err = os.RemoveAll(dataDir); err != nil {
+		return err
+	}
+	if err = os.Mkdir(dataDir, 0700); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dataDir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(path, dataDir+string(filepath.Separator)) {
+			return fmt.Errorf("invalid snapshot entry: '%v'", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)&0700)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported snapshot entry: '%v'", hdr.Name)
+		}
+	}
+}
+
+// isRunning returns true iff the named server is running.
+func (k *Kimchi) isRunning(identifier string) bool {
+	k.Lock()
+	defer k.Unlock()
+	_, ok := k.serverByID[identifier]
+	return ok
+}
@@ -0,0 +1,256 @@
+// socks.go - Katzenpost self contained test network SOCKS5 bridge.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion          = 0x05
+	socksAuthNone         = 0x00
+	socksAuthNoAcceptable = 0xff
+	socksCmdConnect       = 0x01
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+	socksRepSuccess       = 0x00
+	socksRepFailure       = 0x01
+	socksRepNotAllowed    = 0x02
+	socksRepNotSupported  = 0x07
+)
+
+// socksBridge is a minimal SOCKS5 (no authentication, CONNECT only)
+// listener, giving clients a local proxy to reach the providers through.
+// It refuses to connect anywhere other than a provider's advertised
+// address, so it can not be used as a general purpose relay.
+type socksBridge struct {
+	k     *Kimchi
+	l     net.Listener
+	conns map[net.Conn]bool
+}
+
+// StartSOCKSBridge launches a local SOCKS5 listener and returns its
+// address.  Client configs generated with ClientOptions.UseSOCKSBridge
+// route their connections through it.  The bridge is stopped by Shutdown.
+func (k *Kimchi) StartSOCKSBridge() (string, error) {
+	k.Lock()
+	defer k.Unlock()
+	if k.socksBridge != nil {
+		return k.socksBridge.l.Addr().String(), nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	b := &socksBridge{k: k, l: l, conns: make(map[net.Conn]bool)}
+	k.socksBridge = b
+	k.Add(1)
+	go b.acceptLoop()
+	log.Printf("SOCKS5 bridge listening on %v", l.Addr())
+	return l.Addr().String(), nil
+}
+
+// stopSOCKSBridge closes the bridge's listener and every connection it is
+// forwarding.
+func (k *Kimchi) stopSOCKSBridge() {
+	k.Lock()
+	defer k.Unlock()
+	b := k.socksBridge
+	k.socksBridge = nil
+	if b == nil {
+		return
+	}
+	b.l.Close()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+// track records a connection handled by the bridge, so that it is closed
+// when the bridge stops.  If the bridge has already stopped, conn is
+// closed and false is returned.
+func (b *socksBridge) track(conn net.Conn) bool {
+	b.k.Lock()
+	defer b.k.Unlock()
+	if b.conns == nil {
+		conn.Close()
+		return false
+	}
+	b.conns[conn] = true
+	return true
+}
+
+func (b *socksBridge) untrack(conn net.Conn) {
+	b.k.Lock()
+	defer b.k.Unlock()
+	delete(b.conns, conn)
+}
+
+func (b *socksBridge) acceptLoop() {
+	defer b.k.Done()
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		b.k.Add(1)
+		go b.handle(conn)
+	}
+}
+
+func (b *socksBridge) handle(conn net.Conn) {
+	defer b.k.Done()
+	if !b.track(conn) {
+		return
+	}
+	defer b.untrack(conn)
+	defer conn.Close()
+
+	addr, err := socksHandshake(conn)
+	if err != nil {
+		log.Printf("SOCKS5 bridge: handshake failed: %v", err)
+		return
+	}
+	if !b.k.isProviderAddress(addr) {
+		socksReply(conn, socksRepNotAllowed)
+		log.Printf("SOCKS5 bridge: refusing to connect to '%v', which is not a provider", addr)
+		return
+	}
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		socksReply(conn, socksRepFailure)
+		log.Printf("SOCKS5 bridge: failed to dial '%v': %v", addr, err)
+		return
+	}
+	if !b.track(upstream) {
+		return
+	}
+	defer b.untrack(upstream)
+	defer upstream.Close()
+	if err = socksReply(conn, socksRepSuccess); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	b.k.Add(2)
+	go func() {
+		defer b.k.Done()
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		defer b.k.Done()
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// socksHandshake reads the method negotiation and CONNECT request from
+// conn, and returns the requested address.
+func socksHandshake(conn net.Conn) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version: %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == socksAuthNone {
+			method = socksAuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method != socksAuthNone {
+		return "", errors.New("no supported authentication method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(conn, socksRepNotSupported)
+		return "", fmt.Errorf("unsupported command: %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type: %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// isProviderAddress returns true iff addr is an address advertised by one
+// of the providers.
+func (k *Kimchi) isProviderAddress(addr string) bool {
+	k.Lock()
+	defer k.Unlock()
+	for _, nodeCfg := range k.nodeConfigs {
+		if !nodeCfg.Server.IsProvider {
+			continue
+		}
+		if containsString(k.advertisedAddresses(nodeCfg.Server.Addresses), addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,99 @@
+// supervisor.go - Katzenpost self contained test network supervision.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"log"
+	"sync"
+)
+
+// supervisor is a server that relaunches the wrapped server whenever it
+// exits on its own, up to maxRestarts times.
+type supervisor struct {
+	sync.Mutex
+
+	identifier  string
+	newFn       func() (server, error)
+	maxRestarts int
+
+	cur      server
+	stopping bool
+	doneCh   chan struct{}
+}
+
+// supervise launches a server with newFn and returns a supervisor for it.
+func supervise(identifier string, maxRestarts int, newFn func() (server, error)) (*supervisor, error) {
+	svr, err := newFn()
+	if err != nil {
+		return nil, err
+	}
+	s := &supervisor{
+		identifier:  identifier,
+		newFn:       newFn,
+		maxRestarts: maxRestarts,
+		cur:         svr,
+		doneCh:      make(chan struct{}),
+	}
+	go s.worker()
+	return s, nil
+}
+
+func (s *supervisor) worker() {
+	defer close(s.doneCh)
+
+	restarts := 0
+	for {
+		s.Lock()
+		svr := s.cur
+		s.Unlock()
+		svr.Wait()
+
+		s.Lock()
+		if s.stopping {
+			s.Unlock()
+			return
+		}
+		if restarts >= s.maxRestarts {
+			log.Printf("%v exited, giving up after %d restarts", s.identifier, restarts)
+			s.Unlock()
+			return
+		}
+		restarts++
+		log.Printf("%v exited, restarting (%d/%d)", s.identifier, restarts, s.maxRestarts)
+		svr, err := s.newFn()
+		if err != nil {
+			log.Printf("Failed to restart %v: %v", s.identifier, err)
+			s.Unlock()
+			return
+		}
+		s.cur = svr
+		s.Unlock()
+	}
+}
+
+func (s *supervisor) Shutdown() {
+	s.Lock()
+	s.stopping = true
+	svr := s.cur
+	s.Unlock()
+	svr.Shutdown()
+	<-s.doneCh
+}
+
+func (s *supervisor) Wait() {
+	<-s.doneCh
+}
@@ -0,0 +1,57 @@
+// tags.go - Katzenpost self contained test network node tags.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import "sort"
+
+// TagNode adds the tag key=val to the node with the given identifier.
+// Tags are orchestration metadata only, and do not change any config.
+func (k *Kimchi) TagNode(identifier, key, val string) {
+	k.Lock()
+	defer k.Unlock()
+	if k.tags == nil {
+		k.tags = make(map[string]map[string][]string)
+	}
+	tags, ok := k.tags[identifier]
+	if !ok {
+		tags = make(map[string][]string)
+		k.tags[identifier] = tags
+	}
+	for _, v := range tags[key] {
+		if v == val {
+			return
+		}
+	}
+	tags[key] = append(tags[key], val)
+}
+
+// NodesWithTag returns the sorted identifiers of the nodes tagged key=val.
+func (k *Kimchi) NodesWithTag(key, val string) []string {
+	k.Lock()
+	defer k.Unlock()
+	var ids []string
+	for id, tags := range k.tags {
+		for _, v := range tags[key] {
+			if v == val {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
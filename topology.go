@@ -0,0 +1,181 @@
+// topology.go - Katzenpost self contained test network topology.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TopologyDOT returns a Graphviz DOT graph of the network: the authorities
+// and their peerings, the providers, and the mixes grouped by the layers of
+// the current consensus.  Mixes are shown unlayered if there is no
+// consensus yet, as the authorities assign the layers.
+func (k *Kimchi) TopologyDOT() string {
+	var layers [][]string
+	if doc, err := k.Consensus(); err == nil {
+		for _, l := range doc.Topology {
+			var layer []string
+			for _, desc := range l {
+				layer = append(layer, desc.Name)
+			}
+			layers = append(layers, layer)
+		}
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	var providers, mixes []string
+	for _, nodeCfg := range k.nodeConfigs {
+		if nodeCfg.Server.IsProvider {
+			providers = append(providers, nodeCfg.Server.Identifier)
+		} else {
+			mixes = append(mixes, nodeCfg.Server.Identifier)
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "digraph kimchi {\n")
+	fmt.Fprintf(&b, "\trankdir=LR;\n")
+
+	fmt.Fprintf(&b, "\tsubgraph cluster_authorities {\n\t\tlabel=\"authorities\";\n")
+	if k.voting {
+		for _, aCfg := range k.votingAuthConfigs {
+			fmt.Fprintf(&b, "\t\t%q [shape=box];\n", aCfg.Authority.Identifier)
+		}
+		for i, aCfg := range k.votingAuthConfigs {
+			for _, peer := range k.votingAuthConfigs[i+1:] {
+				fmt.Fprintf(&b, "\t\t%q -> %q [dir=none];\n", aCfg.Authority.Identifier, peer.Authority.Identifier)
+			}
+		}
+	} else {
+		fmt.Fprintf(&b, "\t\t%q [shape=box];\n", "nonvoting")
+	}
+	fmt.Fprintf(&b, "\t}\n")
+
+	fmt.Fprintf(&b, "\tsubgraph cluster_providers {\n\t\tlabel=\"providers\";\n")
+	for _, id := range providers {
+		fmt.Fprintf(&b, "\t\t%q [shape=doublecircle];\n", id)
+	}
+	fmt.Fprintf(&b, "\t}\n")
+
+	if layers == nil {
+		fmt.Fprintf(&b, "\tsubgraph cluster_mixes {\n\t\tlabel=\"mixes\";\n")
+		for _, id := range mixes {
+			fmt.Fprintf(&b, "\t\t%q;\n", id)
+		}
+		fmt.Fprintf(&b, "\t}\n")
+	} else {
+		for i, layer := range layers {
+			fmt.Fprintf(&b, "\tsubgraph cluster_layer%d {\n\t\tlabel=\"layer %d\";\n", i, i)
+			for _, id := range layer {
+				fmt.Fprintf(&b, "\t\t%q;\n", id)
+			}
+			fmt.Fprintf(&b, "\t}\n")
+		}
+
+		// Packets flow from the providers through each layer in turn and
+		// back to the providers.
+		hops := append([][]string{providers}, layers...)
+		hops = append(hops, providers)
+		for i := 0; i < len(hops)-1; i++ {
+			for _, from := range hops[i] {
+				for _, to := range hops[i+1] {
+					fmt.Fprintf(&b, "\t%q -> %q;\n", from, to)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "}\n")
+	return b.String()
+}
+
+// TopologyFingerprint returns a hash of the generated network: every
+// component's identifier, addresses, data directory relative to the base
+// directory, log file and services, the whitelists and the mix network
+// parameters.  Keys are random and are left out, so two networks generated
+// from the same Options have the same fingerprint.
+func (k *Kimchi) TopologyFingerprint() (string, error) {
+	k.Lock()
+	defer k.Unlock()
+	var lines []string
+	add := func(format string, a ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, a...))
+	}
+	rel := func(path string) string {
+		if r, err := filepath.Rel(k.baseDir, path); err == nil {
+			return r
+		}
+		return path
+	}
+
+	add("voting %v", k.voting)
+	add("parameters %+v", *k.votingParameters())
+	if k.voting {
+		for _, aCfg := range k.votingAuthConfigs {
+			id := aCfg.Authority.Identifier
+			add("authority %v addresses %v", id, aCfg.Authority.Addresses)
+			add("authority %v advertised %v", id, k.advertisedAddresses(aCfg.Authority.Addresses))
+			add("authority %v datadir %v log %v", id, rel(aCfg.Authority.DataDir), aCfg.Logging.File)
+			add("authority %v layers %v min %v", id, aCfg.Debug.Layers, aCfg.Debug.MinNodesPerLayer)
+			add("authority %v peers %v", id, len(aCfg.Authorities))
+		}
+	} else {
+		aCfg := k.authConfig
+		add("authority nonvoting addresses %v", aCfg.Authority.Addresses)
+		add("authority nonvoting advertised %v", k.advertisedAddresses(aCfg.Authority.Addresses))
+		add("authority nonvoting datadir %v log %v", rel(aCfg.Authority.DataDir), aCfg.Logging.File)
+		add("authority nonvoting layers %v min %v", aCfg.Debug.Layers, aCfg.Debug.MinNodesPerLayer)
+	}
+
+	for _, nodeCfg := range k.nodeConfigs {
+		id := nodeCfg.Server.Identifier
+		add("node %v provider %v", id, nodeCfg.Server.IsProvider)
+		add("node %v addresses %v alt %v only-alt %v", id, nodeCfg.Server.Addresses, nodeCfg.Server.AltAddresses, nodeCfg.Server.OnlyAdvertiseAltAddresses)
+		add("node %v datadir %v log %v level %v", id, rel(nodeCfg.Server.DataDir), nodeCfg.Logging.File, nodeCfg.Logging.Level)
+		if nodeCfg.Management != nil {
+			add("node %v management %v %v", id, nodeCfg.Management.Enable, rel(nodeCfg.Management.Path))
+		}
+		if nodeCfg.Provider != nil {
+			for _, kCfg := range nodeCfg.Provider.Kaetzchen {
+				add("node %v kaetzchen %v %v", id, kCfg.Capability, kCfg.Endpoint)
+			}
+			for _, kCfg := range nodeCfg.Provider.CBORPluginKaetzchen {
+				add("node %v plugin %v %v %v", id, kCfg.Capability, kCfg.Endpoint, rel(kCfg.Command))
+			}
+		}
+	}
+
+	providers, mixes, err := k.whitelist()
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(providers)
+	sort.Strings(mixes)
+	add("whitelist providers %v", providers)
+	add("whitelist mixes %v", mixes)
+
+	sort.Strings(lines)
+	h := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(h[:]), nil
+}
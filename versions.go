@@ -0,0 +1,51 @@
+// versions.go - Katzenpost self contained test network versions.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+const katzenpostModulePrefix = "github.com/katzenpost/"
+
+// Versions returns the versions of the Katzenpost modules (server,
+// authority, core, client and so on) in the running binary, keyed by module
+// path.  Replaced modules are reported with the replacement's path and
+// version.  The map is empty if the binary was not built with module
+// support.
+func Versions() map[string]string {
+	versions := make(map[string]string)
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return versions
+	}
+	if strings.HasPrefix(bi.Main.Path, katzenpostModulePrefix) {
+		versions[bi.Main.Path] = bi.Main.Version
+	}
+	for _, m := range bi.Deps {
+		if !strings.HasPrefix(m.Path, katzenpostModulePrefix) {
+			continue
+		}
+		if r := m.Replace; r != nil {
+			versions[m.Path] = r.Path + " " + r.Version
+		} else {
+			versions[m.Path] = m.Version
+		}
+	}
+	return versions
+}
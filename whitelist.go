@@ -0,0 +1,85 @@
+// whitelist.go - Katzenpost self contained test network external nodes.
+// Copyright (C) 2017  Yawning Angel, David Stainton, Masala.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kimchi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+// ExternalNode is a node run outside of kimchi that the authorities
+// whitelist.
+type ExternalNode struct {
+	// Identifier is the node's identifier.  It is required for providers,
+	// and for mixes is only used to name the node in Whitelist.
+	Identifier string
+
+	// IdentityKey is the node's identity public key, in base64 or hex.
+	IdentityKey *eddsa.PublicKey
+}
+
+// ExternalWhitelist is the format of Options.WhitelistFile, for example:
+//
+//	{
+//		"Providers": [{"Identifier": "provider-x", "IdentityKey": "..."}],
+//		"Mixes": [{"Identifier": "mix-x", "IdentityKey": "..."}]
+//	}
+type ExternalWhitelist struct {
+	Providers []*ExternalNode
+	Mixes     []*ExternalNode
+}
+
+func loadWhitelistFile(path string) (*ExternalWhitelist, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w := new(ExternalWhitelist)
+	if err = json.Unmarshal(b, w); err != nil {
+		return nil, fmt.Errorf("invalid whitelist file '%v': %w", path, err)
+	}
+	if err = w.validate(); err != nil {
+		return nil, fmt.Errorf("invalid whitelist file '%v': %w", path, err)
+	}
+	return w, nil
+}
+
+func (w *ExternalWhitelist) validate() error {
+	for _, n := range w.Providers {
+		if n == nil || n.Identifier == "" {
+			return errors.New("provider is missing an identifier")
+		}
+	}
+	for _, n := range append(w.Providers, w.Mixes...) {
+		if n == nil || n.IdentityKey == nil {
+			return errors.New("node is missing an identity key")
+		}
+	}
+	return nil
+}
+
+// externalNodes returns the nodes whitelisted from Options.WhitelistFile.
+func (k *Kimchi) externalNodes() (providers, mixes []*ExternalNode) {
+	if k.extWhitelist == nil {
+		return nil, nil
+	}
+	return k.extWhitelist.Providers, k.extWhitelist.Mixes
+}